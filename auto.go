@@ -0,0 +1,210 @@
+package loong
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/log"
+)
+
+// AutoDetectTimeout 是 auto 模式下等待客户端发送第一个数据包的时间
+var AutoDetectTimeout = 10 * time.Second
+
+const (
+	protocolHTTP = "http"
+	protocolTLS  = "tls"
+	protocolTLCP = "tlcp"
+)
+
+// detectProtocol 根据记录层的头判断协议, TLS 和 TLCP (GM/T 0024) 的第一个
+// 记录都是 handshake (0x16), 然后是两个字节的版本号, TLCP 的版本号为 0x0101,
+// TLS 的为 0x03xx, 其它的都认为是明文的 http
+func detectProtocol(hdr []byte) string {
+	if len(hdr) < 3 || hdr[0] != 0x16 {
+		return protocolHTTP
+	}
+	if hdr[1] == 0x01 && hdr[2] == 0x01 {
+		return protocolTLCP
+	}
+	if hdr[1] == 0x03 {
+		return protocolTLS
+	}
+	return protocolHTTP
+}
+
+// peekConn 是已经预读了部分数据的连接
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// plainConn 是 auto 模式下的明文 http 连接, 见 autoConnContext
+type plainConn struct {
+	*peekConn
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// asyncListener 在单独的 goroutine 中处理每个新的连接 (如判断协议或者握手),
+// 以免慢的客户端阻塞 Accept。dispatch 返回 nil 表示连接已经被处理了
+type asyncListener struct {
+	net.Listener
+	dispatch func(net.Conn) net.Conn
+
+	results   chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newAsyncListener(ln net.Listener, dispatch func(net.Conn) net.Conn) net.Listener {
+	l := &asyncListener{
+		Listener: ln,
+		dispatch: dispatch,
+		results:  make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *asyncListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.results <- acceptResult{err: err}:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go func() {
+			c := l.dispatch(conn)
+			if c == nil {
+				return
+			}
+			select {
+			case l.results <- acceptResult{conn: c}:
+			case <-l.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+func (l *asyncListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *asyncListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// autoListener 在同一个端口上同时支持 TLS, TLCP 和明文 http
+type autoListener struct {
+	tlsConfig  *tls.Config
+	tlcpCerts  certificates
+	acceptHTTP bool
+	handleTLCP func(net.Conn) net.Conn
+	logger     log.Logger
+}
+
+// newAutoListener 创建一个 auto 模式的 listener, handleTLCP 不为 nil 时用它处理 tlcp 连接
+func newAutoListener(ln net.Listener, tlsConfig *tls.Config, tlcpCerts certificates, acceptHTTP bool, handleTLCP func(net.Conn) net.Conn, logger log.Logger) net.Listener {
+	// http.Server.Serve 不会像 ServeTLS 那样设置 NextProtos, 这里要自己启用 http2
+	tlsConfig = tlsConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	l := &autoListener{
+		tlsConfig:  tlsConfig,
+		tlcpCerts:  tlcpCerts,
+		acceptHTTP: acceptHTTP,
+		handleTLCP: handleTLCP,
+		logger:     logger,
+	}
+	return newAsyncListener(ln, l.dispatch)
+}
+
+func (l *autoListener) dispatch(conn net.Conn) net.Conn {
+	conn.SetReadDeadline(time.Now().Add(AutoDetectTimeout))
+	br := bufio.NewReader(conn)
+	hdr, err := br.Peek(3)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+
+	pc := &peekConn{Conn: conn, r: br}
+	switch detectProtocol(hdr) {
+	case protocolTLS:
+		return tls.Server(pc, l.tlsConfig)
+	case protocolTLCP:
+		c, err := tlcpServerConn(l.tlcpCerts, pc)
+		if err != nil {
+			l.logger.Warn("accept tlcp connection fail", log.Stringer("addr", conn.RemoteAddr()), log.Error(err))
+			conn.Close()
+			return nil
+		}
+		if l.handleTLCP != nil {
+			return l.handleTLCP(c)
+		}
+		return c
+	default:
+		if !l.acceptHTTP {
+			conn.Close()
+			return nil
+		}
+		return &plainConn{pc}
+	}
+}
+
+type plainConnKey struct{}
+
+func autoConnContext(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.(*plainConn); ok {
+		return context.WithValue(ctx, plainConnKey{}, true)
+	}
+	return tlcpConnContext(ctx, c)
+}
+
+// redirectPlainHTTP 将 auto 模式下的明文 http 请求重定向到同一个端口的 https
+func redirectPlainHTTP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if plain, _ := r.Context().Value(plainConnKey{}).(bool); !plain {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		port := ""
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			_, port, _ = net.SplitHostPort(addr.String())
+		}
+		HTTPSRedirectHandler(port).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,159 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	for _, test := range []struct {
+		hdr      []byte
+		protocol string
+	}{
+		{hdr: []byte{0x16, 0x01, 0x01}, protocol: protocolTLCP},
+		{hdr: []byte{0x16, 0x03, 0x01}, protocol: protocolTLS},
+		{hdr: []byte{0x16, 0x03, 0x03}, protocol: protocolTLS},
+		{hdr: []byte("GET"), protocol: protocolHTTP},
+		{hdr: []byte("PO"), protocol: protocolHTTP},
+	} {
+		if p := detectProtocol(test.hdr); p != test.protocol {
+			t.Error(test.hdr, ": want", test.protocol, "got", p)
+		}
+	}
+}
+
+func TestAutoListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certFile, keyFile, 1, time.Now().Add(time.Hour))
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newAutoListener(ln, &tls.Config{GetCertificate: reloader.GetCertificate}, nil, true, nil, logtest.NewLogger(t))
+
+	srv := &http.Server{
+		Handler: redirectPlainHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				io.WriteString(w, "tls")
+			} else {
+				io.WriteString(w, "plain")
+			}
+		})),
+		ConnContext: autoConnContext,
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	addr := ln.Addr().String()
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	response, err := client.Get("https://" + addr + "/a?b=c")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bs, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bs) != "tls" {
+		t.Error("want tls got", string(bs))
+	}
+
+	response, err = client.Get("http://" + addr + "/a?b=c")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusPermanentRedirect {
+		t.Error("want 308 got", response.StatusCode)
+	}
+	if location := response.Header.Get("Location"); location != "https://"+addr+"/a?b=c" {
+		t.Error("want https://"+addr+"/a?b=c got", location)
+	}
+
+	// 没有 tlcp 证书时直接关闭连接
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x16, 0x01, 0x01, 0x00, 0x10})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Error("want error got ok")
+	}
+}
+
+func TestRunnerAutoPlainHTTP(t *testing.T) {
+	// auto 模式同时需要 tls 和 tlcp 的证书
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		plainHTTP string
+		code      int
+	}{
+		{plainHTTP: "accept", code: http.StatusOK},
+		{plainHTTP: "redirect", code: http.StatusPermanentRedirect},
+		{plainHTTP: "", code: 0},
+	} {
+		r := &Runner{
+			Logger:     logtest.NewLogger(t),
+			Network:    "auto",
+			ListenAt:   "127.0.0.1:0",
+			SelfSigned: SelfSignedConfig{Dir: dir},
+			PlainHTTP:  test.plainHTTP,
+		}
+		err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr, _ := r.ListenAddr()
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		response, err := client.Get("http://" + addr.String() + "/a")
+		if test.code == 0 {
+			if err == nil {
+				response.Body.Close()
+				t.Error(test.plainHTTP, ": want error got", response.StatusCode)
+			}
+		} else if err != nil {
+			t.Error(test.plainHTTP, ":", err)
+		} else {
+			response.Body.Close()
+			if response.StatusCode != test.code {
+				t.Error(test.plainHTTP, ": want", test.code, "got", response.StatusCode)
+			}
+		}
+		r.Stop(ctx)
+	}
+}
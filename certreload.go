@@ -0,0 +1,245 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+// certificates 是可以在运行时重新加载的证书, 见 Runner.ReloadCertificates
+type certificates interface {
+	Files() []string
+	Reload() error
+}
+
+// CertificateReloader 通过 tls.Config.GetCertificate 提供证书, 调用 Reload
+// 时重新加载文件, 新的文件无效时继续使用原来的证书
+type CertificateReloader struct {
+	certFile       string
+	keyFile        string
+	ocspStapleFile string
+	cert           atomic.Pointer[tls.Certificate]
+}
+
+// NewCertificateReloader 创建一个 CertificateReloader, ocspStapleFile 为可选的
+// DER 格式的 OCSP 响应, 它会和证书一起发送给客户端 (OCSP stapling)
+func NewCertificateReloader(certFile, keyFile string, ocspStapleFile ...string) (*CertificateReloader, error) {
+	c := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if len(ocspStapleFile) > 0 {
+		c.ocspStapleFile = ocspStapleFile[0]
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertificateReloader) Files() []string {
+	if c.ocspStapleFile != "" {
+		return []string{c.certFile, c.keyFile, c.ocspStapleFile}
+	}
+	return []string{c.certFile, c.keyFile}
+}
+
+// Reload 重新加载证书, 已经有证书时已过期的新证书会被拒绝, 继续使用原来的证书
+func (c *CertificateReloader) Reload() error {
+	cert, err := LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert.Load() != nil {
+		if err = checkCertificateExpiry(&cert, c.certFile); err != nil {
+			return err
+		}
+	}
+	if c.ocspStapleFile != "" {
+		cert.OCSPStaple, err = os.ReadFile(c.ocspStapleFile)
+		if err != nil {
+			return errors.Wrap(err, "load ocsp staple '"+c.ocspStapleFile+"' fail")
+		}
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *CertificateReloader) Certificate() *tls.Certificate {
+	return c.cert.Load()
+}
+
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// LoadX509KeyPair 和 tls.LoadX509KeyPair 一样, 但是会解析 Leaf
+func LoadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, errors.Wrap(err, "load certificate '"+certFile+"' fail")
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return cert, errors.Wrap(err, "parse certificate '"+certFile+"' fail")
+		}
+	}
+	return cert, nil
+}
+
+// checkCertificateExpiry 用于重新加载证书时, 已过期的证书不能替换当前的证书。
+// 启动时不检查, 以免原来可以启动的 (证书已过期的) 服务无法启动
+func checkCertificateExpiry(cert *tls.Certificate, certFile string) error {
+	if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+		return errors.New("certificate '" + certFile + "' is expired at " + cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func statFiles(files []string) []fileStamp {
+	stamps := make([]fileStamp, len(files))
+	for idx, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			stamps[idx] = fileStamp{size: fi.Size(), modTime: fi.ModTime()}
+		}
+	}
+	return stamps
+}
+
+func isSameStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx].size != b[idx].size || !a[idx].modTime.Equal(b[idx].modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchCertificates 定时检查证书文件, 文件有变化时重新加载
+func watchCertificates(ctx context.Context, interval time.Duration, certs []certificates, logger log.Logger) {
+	stamps := make([][]fileStamp, len(certs))
+	for idx, c := range certs {
+		stamps[idx] = statFiles(c.Files())
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for idx, c := range certs {
+			current := statFiles(c.Files())
+			if isSameStamps(stamps[idx], current) {
+				continue
+			}
+			// 无论成功与否都记下新的状态, 证书和私钥分开写入时, 等另一个文件
+			// 也变化后再重试
+			stamps[idx] = current
+
+			if err := c.Reload(); err != nil {
+				logger.Warn("reload certificate fail, keep the old one",
+					log.StringArray("files", c.Files()), log.Error(err))
+			} else {
+				logger.Info("certificate is reloaded", log.StringArray("files", c.Files()))
+			}
+		}
+	}
+}
+
+// ReloadCertificates 重新加载所有端点的证书, 无效的证书会被拒绝并继续使用原来的证书
+func (r *Runner) ReloadCertificates() error {
+	r.lock.Lock()
+	servers := r.servers
+	r.lock.Unlock()
+
+	if len(servers) == 0 {
+		return ErrServerInitializing
+	}
+
+	var err error
+	for _, es := range servers {
+		for _, c := range es.certs {
+			if e := c.Reload(); e != nil {
+				r.Logger.Warn("reload certificate fail, keep the old one",
+					log.StringArray("files", c.Files()), log.Error(e))
+				err = errors.Join(err, e)
+			} else {
+				r.Logger.Info("certificate is reloaded", log.StringArray("files", c.Files()))
+			}
+		}
+	}
+	return err
+}
+
+// ReloadCertificatesOnSignal 收到信号 (默认为 SIGUSR1) 时调用 ReloadCertificates, 直到 ctx 结束
+func (r *Runner) ReloadCertificatesOnSignal(ctx context.Context, sig ...os.Signal) {
+	if len(sig) == 0 {
+		sig = []os.Signal{sigReloadCertificates}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+
+	go func() {
+		defer signal.Stop(c)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-c:
+				r.Logger.Info("received signal, reload certificates", log.Stringer("signal", s))
+				r.ReloadCertificates()
+			}
+		}
+	}()
+}
+
+func (r *Runner) startWatchCertificates() {
+	if r.CertReloadInterval <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var certs []certificates
+	for _, es := range r.servers {
+		certs = append(certs, es.certs...)
+	}
+	if len(certs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.certWatchCancel = cancel
+	go watchCertificates(ctx, r.CertReloadInterval, certs, r.Logger)
+}
+
+func (r *Runner) stopWatchCertificates() {
+	r.lock.Lock()
+	cancel := r.certWatchCancel
+	r.certWatchCancel = nil
+	r.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -0,0 +1,177 @@
+package loong
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerReloadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certFile, keyFile, 1, time.Now().Add(time.Hour))
+
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "https",
+		ListenAt: "127.0.0.1:0",
+		KeyFile:  keyFile,
+		CertFile: certFile,
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	u, err := r.URL()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serial := func() int64 {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}}
+		response, err := client.Get(u)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		response.Body.Close()
+		return response.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if s := serial(); s != 1 {
+		t.Error("want 1 got", s)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, 2, time.Now().Add(time.Hour))
+	if err := r.ReloadCertificates(); err != nil {
+		t.Error(err)
+	}
+	if s := serial(); s != 2 {
+		t.Error("want 2 got", s)
+	}
+
+	// 无效的证书会被拒绝, 继续使用原来的证书
+	writeTestCertificate(t, certFile, keyFile, 3, time.Now().Add(-time.Hour))
+	if err := r.ReloadCertificates(); err == nil {
+		t.Error("want error got ok")
+	}
+	if err := os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReloadCertificates(); err == nil {
+		t.Error("want error got ok")
+	}
+	if s := serial(); s != 2 {
+		t.Error("want 2 got", s)
+	}
+}
+
+func TestCertificateReloaderExpired(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	// 启动时不检查证书是否过期
+	writeTestCertificate(t, certFile, keyFile, 1, time.Now().Add(-time.Hour))
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, 2, time.Now().Add(time.Hour))
+	if err := reloader.Reload(); err != nil {
+		t.Error(err)
+	}
+	writeTestCertificate(t, certFile, keyFile, 3, time.Now().Add(-time.Hour))
+	if err := reloader.Reload(); err == nil {
+		t.Error("want error got ok")
+	}
+	if s := reloader.Certificate().Leaf.SerialNumber.Int64(); s != 2 {
+		t.Error("want 2 got", s)
+	}
+}
+
+func TestWatchCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certFile, keyFile, 1, time.Now().Add(time.Hour))
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchCertificates(ctx, 10*time.Millisecond, []certificates{reloader}, logtest.NewLogger(t))
+
+	// 保证文件的修改时间有变化
+	time.Sleep(20 * time.Millisecond)
+	writeTestCertificate(t, certFile, keyFile, 2, time.Now().Add(time.Hour))
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	for i := 0; i < 100; i++ {
+		if reloader.Certificate().Leaf.SerialNumber.Int64() == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("certificate isnot reloaded")
+}
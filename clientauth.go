@@ -0,0 +1,359 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ClientAuthConfig 是 https 和 tlcp 端点的客户端证书认证参数
+//
+//	Mode 的值为:
+//	  none 或为空            不请求客户端证书
+//	  request               请求客户端证书, 但不要求也不校验
+//	  require               要求客户端证书, 但不校验
+//	  verify-if-given       客户端提供了证书时用 CAFile 校验
+//	  require-and-verify    要求客户端证书并用 CAFile 校验
+//	CAFile 为 PEM 格式的 CA 证书, 可以包含多个证书
+//	CRLFiles 为本地的证书吊销列表 (PEM 或 DER 格式), 它们被认为是可信的,
+//	         所以不校验签名, 只按颁发者和序列号匹配
+//	OCSPFiles 为本地的 OCSP 响应 (DER 格式, 每个文件一个证书), 用颁发者校验签名后
+//	         检查客户端证书 (不包括中间 CA) 的状态, revoked、unknown 和已过期的响应
+//	         都会拒绝连接, 没有对应响应的证书不检查。仅用于 tls, tlcp 只支持 CRLFiles
+type ClientAuthConfig struct {
+	Mode      string
+	CAFile    string
+	CRLFiles  []string
+	OCSPFiles []string
+}
+
+func (c *ClientAuthConfig) isVerify() bool {
+	mode, _ := parseClientAuthMode(c.Mode)
+	return mode == tls.VerifyClientCertIfGiven || mode == tls.RequireAndVerifyClientCert
+}
+
+func parseClientAuthMode(mode string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(strings.Replace(mode, "_", "-", -1)) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-and-verify", "verify":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, errors.New("client auth mode '" + mode + "' is unsupported")
+	}
+}
+
+func (c *ClientAuthConfig) validate() error {
+	if _, err := parseClientAuthMode(c.Mode); err != nil {
+		return err
+	}
+	if c.isVerify() && c.CAFile == "" {
+		return errors.New("client auth: caFile is missing")
+	}
+	return nil
+}
+
+func (c *ClientAuthConfig) files() []string {
+	var files []string
+	if c.CAFile != "" {
+		files = append(files, c.CAFile)
+	}
+	files = append(files, c.CRLFiles...)
+	return append(files, c.OCSPFiles...)
+}
+
+// revocationList 是按颁发者分组的已吊销证书的序列号
+type revocationList map[string]map[string]struct{}
+
+func (l revocationList) isRevoked(rawIssuer []byte, serial *big.Int) bool {
+	if l == nil || serial == nil {
+		return false
+	}
+	serials, ok := l[string(rawIssuer)]
+	if !ok {
+		return false
+	}
+	_, ok = serials[serial.String()]
+	return ok
+}
+
+func loadRevocationList(files []string) (revocationList, error) {
+	list := revocationList{}
+	for _, file := range files {
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "load crl '"+file+"' fail")
+		}
+
+		var ders [][]byte
+		for rest := bs; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			ders = append(ders, bs)
+		}
+
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return nil, errors.Wrap(err, "parse crl '"+file+"' fail")
+			}
+			if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+				return nil, errors.New("crl '" + file + "' is expired at " + crl.NextUpdate.Format(time.RFC3339))
+			}
+
+			serials := list[string(crl.RawIssuer)]
+			if serials == nil {
+				serials = map[string]struct{}{}
+				list[string(crl.RawIssuer)] = serials
+			}
+			for _, entry := range crl.RevokedCertificates {
+				serials[entry.SerialNumber.String()] = struct{}{}
+			}
+		}
+	}
+	return list, nil
+}
+
+// ocspResponses 是按证书序列号分组的 OCSP 响应
+type ocspResponses map[string][][]byte
+
+func loadOCSPResponses(files []string) (ocspResponses, error) {
+	responses := ocspResponses{}
+	for _, file := range files {
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ocsp response '"+file+"' fail")
+		}
+		resp, err := ocsp.ParseResponse(bs, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse ocsp response '"+file+"' fail")
+		}
+		serial := resp.SerialNumber.String()
+		responses[serial] = append(responses[serial], bs)
+	}
+	return responses, nil
+}
+
+// check 检查 cert 的 OCSP 响应, 序列号相同的响应可能来自不同的颁发者, 所以只使用
+// 能用 issuer 校验签名的那个
+func (r ocspResponses) check(cert, issuer *x509.Certificate) error {
+	if r == nil || cert.SerialNumber == nil {
+		return nil
+	}
+	var err error
+	for _, raw := range r[cert.SerialNumber.String()] {
+		var resp *ocsp.Response
+		resp, err = ocsp.ParseResponseForCert(raw, cert, issuer)
+		if err != nil {
+			continue
+		}
+		if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+			return errors.New("ocsp response of client certificate '" + cert.Subject.String() + "' is expired at " + resp.NextUpdate.Format(time.RFC3339))
+		}
+		switch resp.Status {
+		case ocsp.Good:
+			return nil
+		case ocsp.Revoked:
+			return errors.New("client certificate '" + cert.Subject.String() + "' is revoked")
+		default:
+			return errors.New("client certificate '" + cert.Subject.String() + "' has unknown ocsp status")
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "ocsp response of client certificate '"+cert.Subject.String()+"' is invalid")
+	}
+	return nil
+}
+
+// clientVerifier 校验 tls 的客户端证书, CA、CRL 和 OCSP 响应可以通过 Reload 重新加载
+type clientVerifier struct {
+	config  ClientAuthConfig
+	mode    tls.ClientAuthType
+	pool    atomic.Pointer[x509.CertPool]
+	revoked atomic.Pointer[revocationList]
+	ocsp    atomic.Pointer[ocspResponses]
+}
+
+func newClientVerifier(config ClientAuthConfig) (*clientVerifier, error) {
+	mode, err := parseClientAuthMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+	v := &clientVerifier{config: config, mode: mode}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *clientVerifier) Files() []string {
+	return v.config.files()
+}
+
+func (v *clientVerifier) Reload() error {
+	var pool *x509.CertPool
+	if v.config.CAFile != "" {
+		bs, err := os.ReadFile(v.config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "load ca '"+v.config.CAFile+"' fail")
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return errors.New("ca '" + v.config.CAFile + "' has no certificate")
+		}
+	}
+	revoked, err := loadRevocationList(v.config.CRLFiles)
+	if err != nil {
+		return err
+	}
+	responses, err := loadOCSPResponses(v.config.OCSPFiles)
+	if err != nil {
+		return err
+	}
+
+	v.pool.Store(pool)
+	v.revoked.Store(&revoked)
+	v.ocsp.Store(&responses)
+	return nil
+}
+
+// configure 设置 tls.Config, 为了能重新加载 CA, ClientCAs 是在
+// GetConfigForClient 中设置的
+func (v *clientVerifier) configure(cfg *tls.Config) {
+	cfg.ClientAuth = v.mode
+	if v.mode == tls.NoClientCert {
+		return
+	}
+
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		revoked := v.revoked.Load()
+		responses := v.ocsp.Load()
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if revoked.isRevoked(cert.RawIssuer, cert.SerialNumber) {
+					return errors.New("client certificate '" + cert.Subject.String() + "' is revoked")
+				}
+			}
+			if len(chain) > 1 {
+				if err := responses.check(chain[0], chain[1]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	// GetConfigForClient 返回的 tls.Config 不会再被 http.Server 修改, 所以
+	// 这里要和 http.Server 一样启用 http2
+	base := cfg.Clone()
+	if len(base.NextProtos) == 0 {
+		base.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	// 只在 CA 变化时才生成新的 tls.Config, 以免每次握手都生成新的 session ticket key
+	var current atomic.Pointer[tls.Config]
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool := v.pool.Load()
+		if c := current.Load(); c != nil && c.ClientCAs == pool {
+			return c, nil
+		}
+		c := base.Clone()
+		c.ClientCAs = pool
+		current.Store(c)
+		return c, nil
+	}
+}
+
+// CertificateIdentity 是已校验的客户端证书中的身份信息, tls 和 tlcp (SM2) 的证书都转换为它
+type CertificateIdentity struct {
+	Subject        pkix.Name
+	Issuer         pkix.Name
+	SerialNumber   *big.Int
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	NotBefore      time.Time
+	NotAfter       time.Time
+
+	// SM2 为 true 时表示证书来自 tlcp 连接
+	SM2 bool
+	Raw []byte
+}
+
+func identityFromX509(cert *x509.Certificate) *CertificateIdentity {
+	return &CertificateIdentity{
+		Subject:        cert.Subject,
+		Issuer:         cert.Issuer,
+		SerialNumber:   cert.SerialNumber,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		NotBefore:      cert.NotBefore,
+		NotAfter:       cert.NotAfter,
+		Raw:            cert.Raw,
+	}
+}
+
+// PeerIdentity 返回请求中已校验的客户端证书, 没有时返回 nil
+func PeerIdentity(req *http.Request) *CertificateIdentity {
+	if req.TLS != nil {
+		if len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+			return nil
+		}
+		return identityFromX509(req.TLS.VerifiedChains[0][0])
+	}
+	return tlcpPeerIdentity(req.Context())
+}
+
+// ClientCertAuth 返回一个用客户端证书认证的 AuthValidateFunc, 它可以和 TokenVerify
+// 一起用于 HTTPAuth, 没有已校验的客户端证书时返回 ErrTokenNotFound 以便尝试下一个。
+// toUser 将证书转换为用户并通过 ContextWithUser 保存, 为 nil 时保存 *CertificateIdentity
+func ClientCertAuth(toUser func(ctx context.Context, id *CertificateIdentity) (interface{}, error)) AuthValidateFunc {
+	return func(ctx context.Context, req *http.Request) (context.Context, error) {
+		id := PeerIdentity(req)
+		if id == nil {
+			return nil, ErrTokenNotFound
+		}
+
+		if toUser == nil {
+			return ContextWithUser(ctx, id), nil
+		}
+		u, err := toUser(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return nil, ErrUserNotFound
+		}
+		return ContextWithUser(ctx, u), nil
+	}
+}
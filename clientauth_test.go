@@ -0,0 +1,292 @@
+package loong
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, certFile string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: cn},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{usage},
+		EmailAddresses: []string{cn + "@example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writeCRL(t *testing.T, file string, serials ...int64) {
+	t.Helper()
+
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ca *testCA) writeOCSP(t *testing.T, file string, serial int64, status int, nextUpdate time.Time) {
+	t.Helper()
+
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: big.NewInt(serial),
+		ThisUpdate:   time.Now().Add(-2 * time.Hour),
+		NextUpdate:   nextUpdate,
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = time.Now().Add(-time.Hour)
+	}
+	der, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, der, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientVerifierOCSP(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := newTestCA(t, caFile)
+	other := newTestCA(t, filepath.Join(dir, "other.crt"))
+
+	var files []string
+	for _, test := range []struct {
+		ca         *testCA
+		serial     int64
+		status     int
+		nextUpdate time.Time
+	}{
+		{ca: ca, serial: 100, status: ocsp.Good, nextUpdate: time.Now().Add(time.Hour)},
+		{ca: ca, serial: 101, status: ocsp.Revoked, nextUpdate: time.Now().Add(time.Hour)},
+		{ca: ca, serial: 102, status: ocsp.Unknown, nextUpdate: time.Now().Add(time.Hour)},
+		{ca: ca, serial: 103, status: ocsp.Good, nextUpdate: time.Now().Add(-time.Hour)},
+		// 序列号相同但是由其它的 CA 签发的响应被忽略
+		{ca: other, serial: 100, status: ocsp.Revoked, nextUpdate: time.Now().Add(time.Hour)},
+		// 签名无效的响应
+		{ca: other, serial: 105, status: ocsp.Good, nextUpdate: time.Now().Add(time.Hour)},
+	} {
+		file := filepath.Join(dir, strconv.Itoa(len(files))+".ocsp")
+		test.ca.writeOCSP(t, file, test.serial, test.status, test.nextUpdate)
+		files = append(files, file)
+	}
+
+	v, err := newClientVerifier(ClientAuthConfig{
+		Mode:      "require-and-verify",
+		CAFile:    caFile,
+		OCSPFiles: files,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{}
+	v.configure(cfg)
+
+	for serial, want := range map[int64]string{
+		100: "",
+		101: "is revoked",
+		102: "unknown ocsp status",
+		103: "is expired",
+		104: "",
+		105: "is invalid",
+	} {
+		leaf, err := x509.ParseCertificate(ca.issue(t, serial, "device1", x509.ExtKeyUsageClientAuth).Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cfg.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, ca.cert}})
+		if want == "" {
+			if err != nil {
+				t.Error(serial, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), want) {
+			t.Error(serial, "want", want, "got", err)
+		}
+	}
+
+	if err := os.WriteFile(files[0], []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Reload(); err == nil {
+		t.Error("want error got ok")
+	}
+}
+
+func TestRunnerClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	crlFile := filepath.Join(dir, "ca.crl")
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certFile, keyFile, 1, time.Now().Add(time.Hour))
+
+	ca := newTestCA(t, caFile)
+	ca.writeCRL(t, crlFile)
+	clientCert := ca.issue(t, 100, "device1", x509.ExtKeyUsageClientAuth)
+
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "https",
+		ListenAt: "127.0.0.1:0",
+		KeyFile:  keyFile,
+		CertFile: certFile,
+		ClientAuth: ClientAuthConfig{
+			Mode:     "require-and-verify",
+			CAFile:   caFile,
+			CRLFiles: []string{crlFile},
+		},
+	}
+
+	auth := ClientCertAuth(func(ctx context.Context, id *CertificateIdentity) (interface{}, error) {
+		return id.Subject.CommonName + "," + id.EmailAddresses[0], nil
+	})
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, err := auth(req.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, UserFromContext(c).(string))
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	u, err := r.URL()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		response, err := client.Get(u)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		bs, err := io.ReadAll(response.Body)
+		return string(bs), err
+	}
+
+	if s, err := get(clientCert); err != nil {
+		t.Error(err)
+	} else if s != "device1,device1@example.com" {
+		t.Error("want device1,device1@example.com got", s)
+	}
+
+	if _, err := get(); err == nil {
+		t.Error("want error got ok")
+	}
+
+	other := newTestCA(t, filepath.Join(dir, "other.crt"))
+	if _, err := get(other.issue(t, 100, "device1", x509.ExtKeyUsageClientAuth)); err == nil {
+		t.Error("want error got ok")
+	}
+
+	ca.writeCRL(t, crlFile, 100)
+	if err := r.ReloadCertificates(); err != nil {
+		t.Error(err)
+	}
+	if _, err := get(clientCert); err == nil {
+		t.Error("want error got ok")
+	}
+}
+
+func TestClientCertAuthNotFound(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+	req.TLS = &tls.ConnectionState{}
+	if _, err := ClientCertAuth(nil)(context.Background(), req); err != ErrTokenNotFound {
+		t.Error("want ErrTokenNotFound got", err)
+	}
+
+	if _, err := parseClientAuthMode("unknown"); err == nil {
+		t.Error("want error got ok")
+	}
+	c := ClientAuthConfig{Mode: "verify-if-given"}
+	if err := c.validate(); err == nil {
+		t.Error("want error got ok")
+	}
+}
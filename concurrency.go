@@ -0,0 +1,310 @@
+package loong
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+var ErrOverloaded = errors.NewHTTPError(http.StatusServiceUnavailable, "server is overloaded")
+
+const (
+	ConcurrencyAIMD     = "aimd"
+	ConcurrencyGradient = "gradient"
+)
+
+// Priority 是请求的优先级, 过载时低优先级的请求先被拒绝, PriorityCritical 的请求
+// (如健康检查和管理接口) 不受限制
+type Priority int
+
+const (
+	PriorityLow      Priority = -1
+	PriorityNormal   Priority = 0
+	PriorityHigh     Priority = 1
+	PriorityCritical Priority = 2
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// share 是该优先级可以使用的并发数占 limit 的比例
+func (p Priority) share() float64 {
+	switch {
+	case p >= PriorityHigh:
+		return 1
+	case p == PriorityNormal:
+		return 0.9
+	default:
+		return 0.5
+	}
+}
+
+// DefaultConcurrencyPriority 中 /internal/ 下的路由 (healthz, readyz, metrics 等) 是
+// PriorityCritical, 其它是 PriorityNormal
+func DefaultConcurrencyPriority(c *Context) Priority {
+	if strings.HasPrefix(c.Path(), "/internal/") {
+		return PriorityCritical
+	}
+	return PriorityNormal
+}
+
+// ConcurrencyLimitConfig defines the config for ConcurrencyLimit middleware.
+type ConcurrencyLimitConfig struct {
+	// Name 是 metrics 中 limiter 标签的值, 不能为空, 每个 limiter 的 Name 必须
+	// 不同, 否则它们的 metrics 会互相覆盖
+	Name string
+
+	// Algorithm 是调整 limit 的算法, aimd (默认) 或 gradient
+	//   aimd      请求的延时超过 LatencyThreshold 或者返回 503/504 时 limit 乘以
+	//             BackoffRatio, 否则 limit 加 1
+	//   gradient  按长期的平均延时和当前延时的比值调整 limit, 延时变大时 limit 变小
+	Algorithm string
+
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+
+	// LatencyThreshold 默认是 1s, 仅用于 aimd
+	LatencyThreshold time.Duration
+	// BackoffRatio 默认是 0.9, 仅用于 aimd
+	BackoffRatio float64
+	// Smoothing 默认是 0.2, 仅用于 gradient
+	Smoothing float64
+
+	// Priority 返回请求的优先级, 默认是 DefaultConcurrencyPriority
+	Priority func(c *Context) Priority
+
+	// RetryAfter 是拒绝请求时 Retry-After 头的值, 默认是 1s
+	RetryAfter time.Duration
+}
+
+var DefaultConcurrencyLimitConfig = ConcurrencyLimitConfig{
+	Algorithm:        ConcurrencyAIMD,
+	InitialLimit:     20,
+	MinLimit:         1,
+	MaxLimit:         1000,
+	LatencyThreshold: time.Second,
+	BackoffRatio:     0.9,
+	Smoothing:        0.2,
+	Priority:         DefaultConcurrencyPriority,
+	RetryAfter:       time.Second,
+}
+
+// gradientLongWindow 是长期平均延时的样本数
+const gradientLongWindow = 100
+
+// ConcurrencyLimiter 是自适应的并发数限制器, 它按观察到的延时调整允许的并发数,
+// 超过时立即拒绝请求而不是排队, 通常每个 Party 使用一个
+type ConcurrencyLimiter struct {
+	config ConcurrencyLimitConfig
+
+	lock     sync.Mutex
+	limit    float64
+	inFlight int
+	longRTT  float64
+
+	limitGauge    prometheus.Gauge
+	inFlightGauge prometheus.Gauge
+}
+
+func NewConcurrencyLimiter(config ConcurrencyLimitConfig) *ConcurrencyLimiter {
+	if config.Name == "" {
+		panic(errors.New("concurrency limit: name is missing"))
+	}
+	switch config.Algorithm {
+	case "":
+		config.Algorithm = DefaultConcurrencyLimitConfig.Algorithm
+	case ConcurrencyAIMD, ConcurrencyGradient:
+	default:
+		panic(errors.New("concurrency limit: unknown algorithm '" + config.Algorithm + "'"))
+	}
+	if config.MinLimit <= 0 {
+		config.MinLimit = DefaultConcurrencyLimitConfig.MinLimit
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = DefaultConcurrencyLimitConfig.MaxLimit
+	}
+	if config.MaxLimit < config.MinLimit {
+		config.MaxLimit = config.MinLimit
+	}
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = DefaultConcurrencyLimitConfig.InitialLimit
+	}
+	if config.LatencyThreshold <= 0 {
+		config.LatencyThreshold = DefaultConcurrencyLimitConfig.LatencyThreshold
+	}
+	if config.BackoffRatio <= 0 || config.BackoffRatio >= 1 {
+		config.BackoffRatio = DefaultConcurrencyLimitConfig.BackoffRatio
+	}
+	if config.Smoothing <= 0 || config.Smoothing > 1 {
+		config.Smoothing = DefaultConcurrencyLimitConfig.Smoothing
+	}
+	if config.Priority == nil {
+		config.Priority = DefaultConcurrencyLimitConfig.Priority
+	}
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = DefaultConcurrencyLimitConfig.RetryAfter
+	}
+
+	registerMetrics()
+	l := &ConcurrencyLimiter{
+		config:        config,
+		limitGauge:    concurrencyLimit.WithLabelValues(config.Name),
+		inFlightGauge: concurrencyInFlight.WithLabelValues(config.Name),
+	}
+	l.limit = l.clamp(float64(config.InitialLimit))
+	l.limitGauge.Set(math.Floor(l.limit))
+	return l
+}
+
+// Limit 返回当前允许的并发数
+func (l *ConcurrencyLimiter) Limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.limit)
+}
+
+// InFlight 返回当前正在处理的请求数, 不包括 PriorityCritical 的请求
+func (l *ConcurrencyLimiter) InFlight() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inFlight
+}
+
+func (l *ConcurrencyLimiter) clamp(limit float64) float64 {
+	return math.Max(float64(l.config.MinLimit), math.Min(float64(l.config.MaxLimit), limit))
+}
+
+// Acquire 为一个请求申请并发数, 成功时必须在请求结束后调用 Release
+func (l *ConcurrencyLimiter) Acquire(p Priority) bool {
+	if p >= PriorityCritical {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if float64(l.inFlight) >= math.Max(1, math.Floor(l.limit*p.share())) {
+		return false
+	}
+	l.inFlight++
+	l.inFlightGauge.Inc()
+	return true
+}
+
+// Release 释放 Acquire 申请的并发数, 并按请求的延时调整 limit, dropped 表示请求
+// 因为过载而失败 (如超时)
+func (l *ConcurrencyLimiter) Release(p Priority, latency time.Duration, dropped bool) {
+	if p >= PriorityCritical {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	inFlight := l.inFlight
+	l.inFlight--
+	l.inFlightGauge.Dec()
+
+	if l.config.Algorithm == ConcurrencyGradient {
+		l.limit = l.gradient(inFlight, latency, dropped)
+	} else {
+		l.limit = l.aimd(inFlight, latency, dropped)
+	}
+	l.limitGauge.Set(math.Floor(l.limit))
+}
+
+func (l *ConcurrencyLimiter) aimd(inFlight int, latency time.Duration, dropped bool) float64 {
+	if dropped || latency > l.config.LatencyThreshold {
+		return l.clamp(l.limit * l.config.BackoffRatio)
+	}
+	// 并发数远小于 limit 时延时不能说明 limit 是合适的, 不增加
+	if float64(inFlight)*2 < l.limit {
+		return l.limit
+	}
+	return l.clamp(l.limit + 1)
+}
+
+func (l *ConcurrencyLimiter) gradient(inFlight int, latency time.Duration, dropped bool) float64 {
+	rtt := float64(latency)
+	if rtt <= 0 {
+		rtt = 1
+	}
+	if l.longRTT == 0 {
+		l.longRTT = rtt
+	} else {
+		l.longRTT += (rtt - l.longRTT) / gradientLongWindow
+	}
+	// 延时长期下降后, 让 longRTT 尽快跟上
+	if l.longRTT/rtt > 2 {
+		l.longRTT *= 0.95
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.longRTT/rtt))
+	if dropped {
+		gradient = 0.5
+	}
+	if gradient == 1 && float64(inFlight)*2 < l.limit {
+		return l.limit
+	}
+
+	newLimit := l.limit*gradient + math.Sqrt(l.limit)
+	return l.clamp(l.limit*(1-l.config.Smoothing) + newLimit*l.config.Smoothing)
+}
+
+// Middleware 返回使用这个 limiter 的 middleware, 被拒绝的请求返回 503 和 Retry-After 头
+func (l *ConcurrencyLimiter) Middleware() MiddlewareFunc {
+	retryAfter := durationSeconds(l.config.RetryAfter)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			p := l.config.Priority(c)
+			if !l.Acquire(p) {
+				concurrencyShedTotal.WithLabelValues(l.config.Name, p.String()).Inc()
+
+				c.logger().Debug("server is overloaded, request is shed",
+					log.String("limiter", l.config.Name),
+					log.Stringer("priority", p))
+
+				c.Response().Header().Set(HeaderRetryAfter, retryAfter)
+				return c.returnResultError(ErrOverloaded, http.StatusServiceUnavailable)
+			}
+
+			start := time.Now()
+			dropped := false
+			defer func() {
+				l.Release(p, time.Since(start), dropped)
+			}()
+
+			err := next(c)
+			status := responseStatus(c, err)
+			dropped = status == http.StatusServiceUnavailable ||
+				status == http.StatusGatewayTimeout ||
+				errors.Is(err, context.DeadlineExceeded)
+			return err
+		}
+	}
+}
+
+// ConcurrencyLimit returns a middleware which sheds requests when the adaptive
+// concurrency limit is reached, it is usually used for a Party.
+func ConcurrencyLimit(config ConcurrencyLimitConfig) MiddlewareFunc {
+	return NewConcurrencyLimiter(config).Middleware()
+}
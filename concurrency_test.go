@@ -0,0 +1,169 @@
+package loong
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyLimitConfig{
+		Name:         "test_aimd",
+		InitialLimit: 10,
+		MinLimit:     2,
+		MaxLimit:     11,
+	})
+
+	for i := 0; i < 9; i++ {
+		if !l.Acquire(PriorityNormal) {
+			t.Error("want acquired", i)
+		}
+	}
+	// 低优先级的请求先被拒绝
+	if l.Acquire(PriorityNormal) || l.Acquire(PriorityLow) {
+		t.Error("want rejected")
+	}
+	if !l.Acquire(PriorityHigh) {
+		t.Error("want acquired")
+	}
+	if l.Acquire(PriorityHigh) {
+		t.Error("want rejected")
+	}
+	if !l.Acquire(PriorityCritical) {
+		t.Error("critical is never rejected")
+	}
+	l.Release(PriorityCritical, time.Hour, true)
+	if n := l.InFlight(); n != 10 {
+		t.Error("in flight is", n)
+	}
+
+	l.Release(PriorityHigh, time.Millisecond, false)
+	if limit := l.Limit(); limit != 11 {
+		t.Error("limit is", limit)
+	}
+	l.Release(PriorityNormal, time.Millisecond, false)
+	if limit := l.Limit(); limit != 11 {
+		t.Error("limit is", limit)
+	}
+	l.Release(PriorityNormal, 2*time.Second, false)
+	if limit := l.Limit(); limit != 9 {
+		t.Error("limit is", limit)
+	}
+	for l.InFlight() > 0 {
+		l.Release(PriorityNormal, time.Millisecond, true)
+	}
+	if limit := l.Limit(); limit != 4 {
+		t.Error("limit is", limit)
+	}
+}
+
+func TestConcurrencyLimiterName(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic")
+		}
+	}()
+	NewConcurrencyLimiter(ConcurrencyLimitConfig{})
+}
+
+func TestConcurrencyLimiterGradient(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyLimitConfig{
+		Name:         "test_gradient",
+		Algorithm:    ConcurrencyGradient,
+		InitialLimit: 10,
+	})
+
+	for i := 0; i < 10; i++ {
+		l.Acquire(PriorityHigh)
+	}
+	for i := 0; i < 10; i++ {
+		l.Release(PriorityHigh, 10*time.Millisecond, false)
+		l.Acquire(PriorityHigh)
+	}
+	grown := l.Limit()
+	if grown <= 10 {
+		t.Error("limit is", grown)
+	}
+
+	for i := 0; i < 10; i++ {
+		l.Release(PriorityHigh, 100*time.Millisecond, false)
+		l.Acquire(PriorityHigh)
+	}
+	if limit := l.Limit(); limit >= grown {
+		t.Error("limit is", limit, "grown is", grown)
+	}
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	entered := make(chan struct{})
+	done := make(chan struct{})
+
+	e := New()
+	api := e.Group("/api", ConcurrencyLimit(ConcurrencyLimitConfig{
+		Name:         "test_middleware",
+		InitialLimit: 1,
+		MaxLimit:     1,
+		Priority: func(c *Context) Priority {
+			if strings.HasPrefix(c.Path(), "/api/admin") {
+				return PriorityCritical
+			}
+			return DefaultConcurrencyPriority(c)
+		},
+	}))
+	api.GET("/slow", func(c *Context) error {
+		entered <- struct{}{}
+		<-done
+		return c.String(http.StatusOK, "ok")
+	})
+	api.GET("/fast", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	api.GET("/admin/fast", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() {
+		slow <- do("/api/slow")
+	}()
+	<-entered
+
+	rec := do("/api/fast")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("want 503 got", rec.Code)
+	}
+	if retryAfter := rec.Header().Get(HeaderRetryAfter); retryAfter != "1" {
+		t.Error("retry after is", retryAfter)
+	}
+	var result Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Error(err)
+	} else if result.Success || result.Error == nil {
+		t.Error("want error result got", rec.Body.String())
+	}
+
+	if rec := do("/api/admin/fast"); rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+	if rec := do("/internal/healthz"); rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+
+	close(done)
+	if rec := <-slow; rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+	if rec := do("/api/fast"); rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+}
@@ -0,0 +1,549 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mei-rune/ipfilter"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+	"golang.org/x/net/http2"
+)
+
+type TLCPConfig struct {
+	SigCertFile string
+	SigKeyFile  string
+	EncCertFile string
+	EncKeyFile  string
+}
+
+// UnixSocketConfig 仅在 Network 为 unix 时有效, ListenAt 为 socket 文件的路径,
+// 在 Linux 中以 @ 开头时为抽象 socket。
+//
+// Mode 不为 0 时 socket 文件先以 0600 创建, 修改所有者和权限之后其它用户才能连接;
+// Mode 为 0 时使用进程的 umask 对应的权限
+type UnixSocketConfig struct {
+	Mode  os.FileMode
+	User  string
+	Group string
+}
+
+// Endpoint 是 Runner 的一个监听端点, 同一个 Runner 的所有端点使用同一个
+// handler, 但每个端点有自己的地址、ipfilter 和证书
+type Endpoint struct {
+	Name            string
+	IPFilterOptions ipfilter.Options
+	Network         string
+	ListenAt        string
+
+	KeyFile        string
+	CertFile       string
+	OCSPStapleFile string
+	TLS            TLSConfig
+	ClientAuth     ClientAuthConfig
+	SNI            SNIConfig
+
+	// SelfSigned 的 Dir 不为空时, 如果证书文件不存在则自动生成自签名的证书
+	SelfSigned SelfSignedConfig
+
+	HTTP2 HTTP2Config
+	HTTP3 HTTP3Config
+
+	Limits        LimitsConfig
+	ProxyProtocol ProxyProtocolConfig
+
+	// PlainHTTP 仅在 Network 为 auto 时有效, 决定同一个端口上收到明文 http
+	// 请求时的处理方式: reject (默认, 直接关闭连接)、accept 或 redirect (308 重定向到 https)
+	PlainHTTP string
+
+	TLCP       TLCPConfig
+	UnixSocket UnixSocketConfig
+
+	RedirectHTTP RedirectHTTPConfig
+	HSTS         HSTSConfig
+
+	CandidatePortStart int
+	CandidatePortEnd   int
+}
+
+// scheme 返回端点的 URL 中的 scheme
+func (ep *Endpoint) scheme() (string, error) {
+	switch strings.ToLower(ep.Network) {
+	case "http", "tcp":
+		return "http", nil
+	case "https", "tls", "ssl", "tlcp", "auto", "h3", "quic":
+		return "https", nil
+	case "unix":
+		return "http+unix", nil
+	default:
+		return "", errors.New("network '" + ep.Network + "' is unsupported")
+	}
+}
+
+type endpointServer struct {
+	Endpoint
+
+	network    string
+	isHTTPs    bool
+	isTLCP     bool
+	inheritKey string
+	isAuto     bool
+	isH3       bool
+	tlsConfig  *tls.Config
+	tlcpCerts  certificates
+	certs      []certificates
+
+	srv      *http.Server
+	listener net.Listener
+	conns    *connTracker
+	redirect *redirectServer
+	h2s      *http2.Server
+	h3       *http3Server
+
+	proxyProtocol *proxyProtocol
+}
+
+func newEndpointServer(ep Endpoint) (*endpointServer, error) {
+	es := &endpointServer{Endpoint: ep}
+
+	switch strings.ToLower(ep.Network) {
+	case "http", "tcp":
+		es.network = "tcp"
+	case "unix":
+		es.network = "unix"
+	case "https", "tls", "ssl":
+		es.isHTTPs = true
+		es.network = "tcp"
+		if err := es.bootstrapSelfSigned(true, false); err != nil {
+			return nil, err
+		}
+		if err := es.setupTLS(); err != nil {
+			return nil, err
+		}
+	case "h3", "quic":
+		// tcp 上仍然是 https, 同时在相同端口的 udp 上提供 http3, 见 listenHTTP3
+		if newHTTP3Server == nil {
+			return nil, errors.New("listen: network '" + ep.Network + "' requires import _ \"github.com/runner-mei/loong/h3\"")
+		}
+		es.isHTTPs = true
+		es.isH3 = true
+		es.network = "tcp"
+		if err := es.bootstrapSelfSigned(true, false); err != nil {
+			return nil, err
+		}
+		if err := es.setupTLS(); err != nil {
+			return nil, err
+		}
+	case "tlcp":
+		es.isTLCP = true
+		es.isHTTPs = true
+		es.network = "tcp"
+		if err := es.bootstrapSelfSigned(false, true); err != nil {
+			return nil, err
+		}
+		if err := es.setupTLCP(); err != nil {
+			return nil, err
+		}
+	case "auto":
+		es.isAuto = true
+		es.isHTTPs = true
+		es.network = "tcp"
+		switch strings.ToLower(ep.PlainHTTP) {
+		case "", "reject", "accept", "redirect":
+		default:
+			return nil, errors.New("plain http '" + ep.PlainHTTP + "' is unsupported")
+		}
+		if err := es.bootstrapSelfSigned(true, true); err != nil {
+			return nil, err
+		}
+		if err := es.setupTLS(); err != nil {
+			return nil, err
+		}
+		if err := es.setupTLCP(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("listen: network '" + ep.Network + "' is unsupported")
+	}
+	if ep.ProxyProtocol.IsEnabled() {
+		p, err := newProxyProtocol(ep.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+		es.proxyProtocol = p
+	}
+	es.inheritKey = inheritKey(ep.Name, "")
+	return es, nil
+}
+
+// bootstrapSelfSigned 在启用了 SelfSigned 并且证书文件不存在时生成自签名的证书
+func (es *endpointServer) bootstrapSelfSigned(isTLS, isTLCP bool) error {
+	ep := &es.Endpoint
+	if ep.SelfSigned.Dir == "" || !ep.SNI.IsEmpty() {
+		return nil
+	}
+
+	config := ep.SelfSigned
+	if host, _, err := net.SplitHostPort(ep.ListenAt); err == nil && host != "" && !isZeroAddress(ep.ListenAt) {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			config.Hosts = append(append([]string{}, config.Hosts...), host)
+		}
+	}
+
+	if isTLS {
+		if err := ensureSelfSignedTLS(&config, &ep.CertFile, &ep.KeyFile); err != nil {
+			return errors.Wrap(err, "create self signed certificate fail")
+		}
+	}
+	if isTLCP {
+		if err := ensureSelfSignedTLCP(&config, &ep.TLCP); err != nil {
+			return errors.Wrap(err, "create self signed sm2 certificate fail")
+		}
+	}
+	return nil
+}
+
+func (es *endpointServer) setupTLS() error {
+	ep := &es.Endpoint
+	if (ep.CertFile == "" || ep.KeyFile == "") && ep.SNI.IsEmpty() {
+		return errors.New("keyFile or certFile is missing")
+	}
+	tlsConfig, err := ep.TLS.Build()
+	if err != nil {
+		return err
+	}
+
+	var reloader *CertificateReloader
+	if ep.CertFile != "" || ep.KeyFile != "" {
+		reloader, err = NewCertificateReloader(ep.CertFile, ep.KeyFile, ep.OCSPStapleFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = reloader.GetCertificate
+		es.certs = append(es.certs, reloader)
+	}
+	if !ep.SNI.IsEmpty() {
+		sni, err := newSNICertificates(ep.SNI, reloader)
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = sni.GetCertificate
+		es.certs = append(es.certs, sni)
+	}
+
+	if err := ep.ClientAuth.validate(); err != nil {
+		return err
+	}
+	verifier, err := newClientVerifier(ep.ClientAuth)
+	if err != nil {
+		return err
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = ep.HTTP2.nextProtos()
+	}
+	verifier.configure(tlsConfig)
+	es.certs = append(es.certs, verifier)
+	es.tlsConfig = tlsConfig
+	return nil
+}
+
+func (es *endpointServer) setupTLCP() error {
+	ep := &es.Endpoint
+	if ep.SNI.IsEmpty() || ep.TLCP != (TLCPConfig{}) {
+		if ep.TLCP.SigCertFile == "" || ep.TLCP.SigKeyFile == "" {
+			return errors.New("sig keyFile or certFile is missing")
+		}
+		if ep.TLCP.EncCertFile == "" || ep.TLCP.EncKeyFile == "" {
+			return errors.New("enc keyFile or certFile is missing")
+		}
+	}
+	if err := ep.ClientAuth.validate(); err != nil {
+		return err
+	}
+	certs, err := newTlcpCertificates(ep.TLCP, ep.ClientAuth, ep.SNI, ep.HTTP2.nextProtos())
+	if err != nil {
+		return err
+	}
+	es.tlcpCerts = certs
+	es.certs = append(es.certs, certs)
+	return nil
+}
+
+func (es *endpointServer) listen(handler http.Handler, onShutdown []func()) error {
+	listenAt, ln, err := listenInherit(es.inheritKey, func() (string, net.Listener, error) {
+		listen := func() (string, net.Listener, error) {
+			return ListenAtDynamicPort(es.network, es.ListenAt, es.CandidatePortStart, es.CandidatePortEnd)
+		}
+		// 配置了权限时先以 0600 创建 socket 文件, 修改完成后其它用户才能连接
+		if es.network == "unix" && es.UnixSocket.Mode != 0 {
+			return listenUnixPrivate(listen)
+		}
+		return listen()
+	})
+	if err != nil {
+		return err
+	}
+	if es.network == "unix" {
+		err = chmodUnixSocket(ln.Addr().String(), es.UnixSocket.Mode, es.UnixSocket.User, es.UnixSocket.Group)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	es.listener = ln
+	if err = es.listenRedirect(); err != nil {
+		ln.Close()
+		return err
+	}
+
+	if es.isHTTPs {
+		handler = WrapHSTS(es.HSTS, handler)
+	}
+	if err = es.listenHTTP3(handler); err != nil {
+		es.close()
+		return err
+	}
+	if es.h3 != nil {
+		handler = es.h3.srv.AltSvc(handler)
+	}
+	if es.isAuto && strings.ToLower(es.PlainHTTP) == "redirect" {
+		handler = redirectPlainHTTP(handler)
+	}
+	es.srv = &http.Server{Addr: listenAt, Handler: handler, TLSConfig: es.tlsConfig}
+	es.Limits.configure(es.srv)
+	if err = es.setupHTTP2(); err != nil {
+		es.close()
+		return err
+	}
+	if es.isTLCP || es.isAuto {
+		// tlcp 的连接不是 *tls.Conn, http.Request.TLS 为 nil, 所以要通过
+		// context 取得连接, 见 PeerIdentity
+		es.srv.ConnContext = autoConnContext
+	}
+	for _, f := range onShutdown {
+		es.srv.RegisterOnShutdown(f)
+	}
+	es.conns = &connTracker{conns: map[*trackedConn]struct{}{}}
+	return nil
+}
+
+// inheritables 返回 Restart 时需要交给新进程的 socket (net.Listener 或 net.PacketConn)
+func (es *endpointServer) inheritables() map[string]interface{} {
+	sockets := map[string]interface{}{es.inheritKey: es.listener}
+	if es.redirect != nil {
+		sockets[es.redirect.inheritKey] = es.redirect.listener
+	}
+	if es.h3 != nil {
+		sockets[es.h3.inheritKey] = es.h3.conn
+	}
+	return sockets
+}
+
+// close 关闭还没有开始服务的 listener
+func (es *endpointServer) close() {
+	if es.listener != nil {
+		es.listener.Close()
+	}
+	if es.redirect != nil {
+		es.redirect.listener.Close()
+	}
+	if es.h3 != nil {
+		es.h3.close()
+	}
+}
+
+func (es *endpointServer) serve(logger log.Logger) {
+	if es.redirect != nil {
+		go es.redirect.serve(es.wrapListener(es.redirect.listener, nil, logger), logger)
+	}
+	if es.h3 != nil {
+		go es.h3.serve(logger)
+	}
+
+	logger.Info("http listen at: " + es.Network + "+" + es.listener.Addr().String())
+	listener := es.wrapListener(es.listener, es.conns, logger)
+
+	var err error
+	if es.isAuto {
+		plainHTTP := strings.ToLower(es.PlainHTTP)
+		listener = newAutoListener(listener, es.tlsConfig, es.tlcpCerts, plainHTTP == "accept" || plainHTTP == "redirect",
+			func(conn net.Conn) net.Conn {
+				return es.handleTlcpConn(conn, logger)
+			}, logger)
+		err = es.srv.Serve(listener)
+	} else if es.isTLCP {
+		listener, err = enableTlcp(es.tlcpCerts, listener)
+		if err != nil {
+			logger.Error("enable tlcp unsuccessful", log.Error(err))
+			err = errors.Wrap(err, "enable tlcp unsuccessful")
+		} else {
+			if es.h2s != nil {
+				listener = newAsyncListener(listener, func(conn net.Conn) net.Conn {
+					return es.handleTlcpConn(conn, logger)
+				})
+			}
+			err = es.srv.Serve(listener)
+		}
+	} else if es.isHTTPs {
+		// 证书由 tlsConfig.GetCertificate 提供, 见 CertificateReloader
+		err = es.srv.ServeTLS(listener, "", "")
+	} else {
+		err = es.srv.Serve(listener)
+	}
+	if err != nil {
+		if err != http.ErrServerClosed {
+			logger.Error("http server start unsuccessful", log.Error(err))
+		} else {
+			logger.Info("http server stopped")
+		}
+	}
+}
+
+// wrapListener 对 listener 加上 keepalive、最大连接数、proxy protocol 和 ipfilter,
+// 主端口和重定向端口使用相同的配置。conns 不为 nil 时记录连接, 见 shutdown
+func (es *endpointServer) wrapListener(listener net.Listener, conns *connTracker, logger log.Logger) net.Listener {
+	listenAt := listener.Addr().String()
+
+	listener = es.wrapLimits(listener, logger)
+	if es.proxyProtocol != nil {
+		// 必须在 ipfilter 之前, 这样 ipfilter 检查的是真实的客户端地址
+		listener = es.proxyProtocol.wrap(listener, logger)
+	}
+	listener = wrapMetricsListener(listener, listenAt)
+	if conns != nil {
+		listener = conns.wrap(listener)
+	}
+
+	if !es.IPFilterOptions.TrustProxy {
+		blocked := connBlockedTotal.WithLabelValues(listenAt)
+		listener = ipfilter.WrapListener(listener, es.IPFilterOptions, func(addr net.Addr) {
+			blocked.Inc()
+			if es.IPFilterOptions.Logger != nil {
+				es.IPFilterOptions.Logger.Printf("ip is blocked: addr = %s", addr)
+			} else {
+				logger.Info("ip is blocked", log.Stringer("addr", addr))
+			}
+		})
+	}
+	return listener
+}
+
+func (es *endpointServer) shutdown(ctx context.Context, timeout time.Duration, logger log.Logger) error {
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Shutdown 会等待正在处理的请求, 但不会等待被 Hijack 的连接, 所以
+	// 之后还要等待 conns 中剩余的连接关闭
+	var err0 error
+	if es.redirect != nil {
+		err0 = es.redirect.shutdown(shutdownCtx)
+	}
+
+	// http3 和 tcp 上的请求同时等待
+	var err3 error
+	var wg sync.WaitGroup
+	if es.h3 != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err3 = es.h3.shutdown(shutdownCtx)
+		}()
+	}
+
+	err1 := es.srv.Shutdown(shutdownCtx)
+	if err1 == nil {
+		err1 = es.conns.wait(shutdownCtx)
+	}
+	if err1 != nil {
+		logger.Warn("http server drain timeout, close connections forcibly",
+			log.Int("connections", es.conns.count()), log.Error(err1))
+		err1 = joinErrors(ErrShutdownTimeout, es.srv.Close())
+		es.conns.closeAll()
+	}
+
+	err2 := es.listener.Close()
+	if err2 != nil {
+		if strings.Contains(err2.Error(), "use of closed network connection") {
+			err2 = nil
+		}
+	}
+	wg.Wait()
+	return joinErrors(err0, err1, err2, err3)
+}
+
+type connTracker struct {
+	lock  sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+func (t *connTracker) wrap(ln net.Listener) net.Listener {
+	return &trackedListener{Listener: ln, tracker: t}
+}
+
+func (t *connTracker) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.conns)
+}
+
+func (t *connTracker) wait(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for t.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (t *connTracker) closeAll() {
+	t.lock.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (ln *trackedListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, tracker: ln.tracker}
+	ln.tracker.lock.Lock()
+	ln.tracker.conns[tc] = struct{}{}
+	ln.tracker.lock.Unlock()
+	return tc, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.lock.Lock()
+	delete(c.tracker.conns, c)
+	c.tracker.lock.Unlock()
+	return c.Conn.Close()
+}
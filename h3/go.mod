@@ -0,0 +1,62 @@
+module github.com/runner-mei/loong/h3
+
+// quic-go v0.41.0 需要 go 1.21, 所以 h3 单独放在一个模块中, 主模块仍然是 go 1.20
+go 1.21
+
+require (
+	github.com/mei-rune/ipfilter v1.0.2
+	github.com/quic-go/quic-go v0.41.0
+	github.com/runner-mei/errors v0.0.0-20220725054952-d7c9c10762ea
+	github.com/runner-mei/log v1.0.11
+	github.com/runner-mei/loong v0.0.0-20261019035204-294808172699
+)
+
+require (
+	emperror.dev/emperror v0.33.0 // indirect
+	emperror.dev/errors v0.8.1 // indirect
+	gitee.com/Trisia/gotlcp v1.3.21 // indirect
+	github.com/benbjohnson/clock v1.3.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/emmansun/gmsm v0.27.2 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+	github.com/golang-jwt/jwt/v4 v4.5.1-0.20230219130118-4fd5621d8dd0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/labstack/echo/v4 v4.11.2-0.20230919052447-4bc3e475e313 // indirect
+	github.com/labstack/gommon v0.4.0 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.19 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/mei-rune/csvutil v0.0.0-20221230090625-d3b9c650225d // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/opentracing/opentracing-go v1.2.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_golang v1.17.0 // indirect
+	github.com/prometheus/client_model v0.4.1-0.20230718164431-9a2bf3000d16 // indirect
+	github.com/prometheus/common v0.44.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
+	github.com/quic-go/qpack v0.4.0 // indirect
+	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasttemplate v1.2.2 // indirect
+	go.uber.org/mock v0.3.0 // indirect
+	go.uber.org/multierr v1.11.0 // indirect
+	go.uber.org/zap v1.25.0 // indirect
+	golang.org/x/crypto v0.28.0 // indirect
+	golang.org/x/exp v0.0.0-20231214170342-aacd6d4b4611 // indirect
+	golang.org/x/mod v0.20.0 // indirect
+	golang.org/x/net v0.30.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+	golang.org/x/time v0.3.0 // indirect
+	golang.org/x/tools v0.24.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
+)
+
+// github.com/runner-mei/log v1.0.11 引用了 golang.org/x/exp 的零版本, 这里排除它,
+// 使用上面 require 中真实的 golang.org/x/exp 版本
+exclude golang.org/x/exp v0.0.0-00010101000000-000000000000
@@ -0,0 +1,152 @@
+// Package h3 为 loong.Runner 提供 http3 (quic), 导入它之后 Runner.Network 可以为
+// h3 或 quic:
+//
+//	import _ "github.com/runner-mei/loong/h3"
+//
+// 它是一个独立的 module, 这样没有使用 http3 的程序不用依赖 quic-go。quic-go
+// v0.41.0 需要 go 1.21, 所以只有 h3 需要 go 1.21, 主模块仍然是 go 1.20。
+package h3
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mei-rune/ipfilter"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/loong"
+)
+
+func init() {
+	loong.RegisterHTTP3(NewServer)
+}
+
+func quicConfig(c loong.HTTP3Config) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     c.MaxIdleTimeout,
+		KeepAlivePeriod:    c.KeepAlivePeriod,
+		MaxIncomingStreams: c.MaxIncomingStreams,
+	}
+}
+
+type server struct {
+	srv      *http3.Server
+	conn     net.PacketConn
+	listener *quic.EarlyListener
+	filter   http3.QUICEarlyListener
+	requests atomic.Int64
+}
+
+// NewServer 在 opts.Conn 上创建 http3 服务, 它由 init 注册到 loong
+func NewServer(opts loong.HTTP3Options) (loong.HTTP3Server, error) {
+	_, port, err := net.SplitHostPort(opts.Conn.LocalAddr().String())
+	if err != nil {
+		return nil, errors.Wrap(err, "udp socket has no port")
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, errors.Wrap(err, "udp socket has no port")
+	}
+
+	listener, err := quic.ListenEarly(opts.Conn, http3.ConfigureTLSConfig(opts.TLSConfig), quicConfig(opts.Config))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		conn:     opts.Conn,
+		listener: listener,
+		filter:   listener,
+	}
+	if opts.Filter != nil {
+		s.filter = &filterListener{
+			QUICEarlyListener: listener,
+			filter:            opts.Filter,
+			onBlocked:         opts.OnBlocked,
+		}
+	}
+	s.srv = &http3.Server{
+		Port:           portNum,
+		QuicConfig:     quicConfig(opts.Config),
+		MaxHeaderBytes: opts.MaxHeaderBytes,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.requests.Add(1)
+			defer s.requests.Add(-1)
+			opts.Handler.ServeHTTP(w, r)
+		}),
+	}
+	return s, nil
+}
+
+func (s *server) AltSvc(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			s.srv.SetQuicHeaders(w.Header())
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) Serve() error {
+	err := s.srv.ServeListener(s.filter)
+	if err == quic.ErrServerClosed {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown 等待正在处理的请求完成后关闭所有的连接, quic-go 还不支持 GOAWAY,
+// 所以这段时间内仍然会接收新的请求
+func (s *server) Shutdown(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	var err error
+	for s.requests.Load() > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return errors.Join(err, s.Close())
+}
+
+func (s *server) Close() error {
+	err1 := s.srv.Close()
+	err2 := s.listener.Close()
+	if err2 == nil || err2 == quic.ErrServerClosed {
+		err2 = s.conn.Close()
+	}
+	return errors.Join(err1, err2)
+}
+
+type filterListener struct {
+	http3.QUICEarlyListener
+	filter    *ipfilter.IPFilter
+	onBlocked func(net.Addr)
+}
+
+func (ln *filterListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	for {
+		conn, err := ln.QUICEarlyListener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		addr, ok := conn.RemoteAddr().(*net.UDPAddr)
+		if ok && !addr.IP.IsLoopback() && !ln.filter.NetAllowed(addr.IP) {
+			if ln.onBlocked != nil {
+				ln.onBlocked(addr)
+			}
+			conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeRequestRejected), "ip is blocked")
+			continue
+		}
+		return conn, nil
+	}
+}
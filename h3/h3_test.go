@@ -0,0 +1,76 @@
+package h3
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/runner-mei/log/logtest"
+	"github.com/runner-mei/loong"
+)
+
+func TestRunnerHTTP3(t *testing.T) {
+	r := &loong.Runner{
+		Logger:     logtest.NewLogger(t),
+		Network:    "h3",
+		ListenAt:   "127.0.0.1:0",
+		SelfSigned: loong.SelfSignedConfig{Dir: t.TempDir()},
+		HTTP3:      loong.HTTP3Config{MaxIdleTimeout: time.Minute, MaxIncomingStreams: 10},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, strconv.Itoa(req.ProtoMajor))
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	u, _ := r.URL()
+	port, _ := r.ListenPort()
+	if !strings.HasPrefix(u, "https://") || !strings.HasSuffix(u, ":"+port) {
+		t.Error("url is", u, "port is", port)
+	}
+
+	// tcp 上是普通的 https, 并通过 Alt-Svc 通知客户端 http3 的端口
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	response, err := client.Get(u)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if altSvc := response.Header.Get("Alt-Svc"); !strings.Contains(altSvc, `h3=":`+port+`"`) {
+		t.Error("want alt-svc with port", port, "got", altSvc)
+	}
+
+	roundTripper := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer roundTripper.Close()
+	client = &http.Client{Transport: roundTripper}
+	response, err = client.Get(u)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bs, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bs) != "3" {
+		t.Error("want 3 got", string(bs))
+	}
+	if response.Header.Get("Alt-Svc") != "" {
+		t.Error("alt-svc should not be sent over http3")
+	}
+
+	if err := r.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+}
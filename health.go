@@ -0,0 +1,217 @@
+package loong
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/errors"
+)
+
+var ErrServerNotReady = errors.New("service isnot ready")
+
+type HealthCheckFunc func(ctx context.Context) error
+
+type HealthStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type HealthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]HealthStatus `json:"checks,omitempty"`
+}
+
+const (
+	HealthStatusUp   = "up"
+	HealthStatusDown = "down"
+)
+
+type healthCheck struct {
+	name     string
+	check    HealthCheckFunc
+	timeout  time.Duration
+	cacheTTL time.Duration
+	liveness bool
+
+	lock   sync.Mutex
+	status HealthStatus
+	err    error
+}
+
+func (hc *healthCheck) run(ctx context.Context) (HealthStatus, error) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	if hc.cacheTTL > 0 && !hc.status.CheckedAt.IsZero() &&
+		time.Since(hc.status.CheckedAt) < hc.cacheTTL {
+		return hc.status, hc.err
+	}
+
+	if hc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hc.timeout)
+		defer cancel()
+	}
+
+	// 检测函数可能不理会 ctx, 所以放到 goroutine 中运行, 保证超时能生效
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if o := recover(); o != nil {
+				result <- errors.Recover(o)
+			}
+		}()
+		result <- hc.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "health check '"+hc.name+"' timeout")
+	}
+
+	hc.err = err
+	hc.status = HealthStatus{
+		Status:    HealthStatusUp,
+		Duration:  time.Since(start).String(),
+		CheckedAt: start,
+	}
+	if err != nil {
+		hc.status.Status = HealthStatusDown
+		hc.status.Error = err.Error()
+	}
+	return hc.status, hc.err
+}
+
+// Health 管理健康检测, 其中 liveness 只运行用 RegisterLiveness 注册的检测,
+// readiness 运行所有的检测。
+type Health struct {
+	lock   sync.Mutex
+	checks []*healthCheck
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// Register 注册一个 readiness 检测, timeout 为 0 时不限时, cacheTTL 为 0 时不缓存结果
+func (h *Health) Register(name string, check HealthCheckFunc, timeout, cacheTTL time.Duration) {
+	h.register(name, check, timeout, cacheTTL, false)
+}
+
+// RegisterLiveness 注册一个同时用于 liveness 和 readiness 的检测
+func (h *Health) RegisterLiveness(name string, check HealthCheckFunc, timeout, cacheTTL time.Duration) {
+	h.register(name, check, timeout, cacheTTL, true)
+}
+
+func (h *Health) register(name string, check HealthCheckFunc, timeout, cacheTTL time.Duration, liveness bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	hc := &healthCheck{
+		name:     name,
+		check:    check,
+		timeout:  timeout,
+		cacheTTL: cacheTTL,
+		liveness: liveness,
+	}
+	for idx := range h.checks {
+		if h.checks[idx].name == name {
+			h.checks[idx] = hc
+			return
+		}
+	}
+	h.checks = append(h.checks, hc)
+}
+
+func (h *Health) Unregister(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for idx := range h.checks {
+		if h.checks[idx].name == name {
+			h.checks = append(h.checks[:idx], h.checks[idx+1:]...)
+			return
+		}
+	}
+}
+
+// AddRunner 将 Runner 的状态加入 readiness 检测, Runner.Stop 开始后
+// readiness 立即变为 false, 直到所有的 OnStart 成功后才变为 true
+func (h *Health) AddRunner(name string, r *Runner) {
+	h.Register(name, func(ctx context.Context) error {
+		if !r.IsReady() {
+			return ErrServerNotReady
+		}
+		return nil
+	}, 0, 0)
+}
+
+func (h *Health) Liveness(ctx context.Context) (HealthReport, bool) {
+	return h.run(ctx, true)
+}
+
+func (h *Health) Readiness(ctx context.Context) (HealthReport, bool) {
+	return h.run(ctx, false)
+}
+
+func (h *Health) run(ctx context.Context, livenessOnly bool) (HealthReport, bool) {
+	h.lock.Lock()
+	checks := make([]*healthCheck, 0, len(h.checks))
+	for _, hc := range h.checks {
+		if !livenessOnly || hc.liveness {
+			checks = append(checks, hc)
+		}
+	}
+	h.lock.Unlock()
+
+	statusList := make([]HealthStatus, len(checks))
+	var wg sync.WaitGroup
+	for idx := range checks {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			statusList[idx], _ = checks[idx].run(ctx)
+		}(idx)
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: HealthStatusUp}
+	if len(checks) > 0 {
+		report.Checks = map[string]HealthStatus{}
+	}
+	for idx := range checks {
+		report.Checks[checks[idx].name] = statusList[idx]
+		if statusList[idx].Status != HealthStatusUp {
+			report.Status = HealthStatusDown
+		}
+	}
+	return report, report.Status == HealthStatusUp
+}
+
+func (h *Health) LivenessHandler() HandlerFunc {
+	return func(c *Context) error {
+		report, ok := h.Liveness(c.StdContext)
+		return returnHealthReport(c, report, ok)
+	}
+}
+
+func (h *Health) ReadinessHandler() HandlerFunc {
+	return func(c *Context) error {
+		report, ok := h.Readiness(c.StdContext)
+		return returnHealthReport(c, report, ok)
+	}
+}
+
+func returnHealthReport(c *Context, report HealthReport, ok bool) error {
+	if ok {
+		return c.JSON(http.StatusOK, &Result{Success: true, Data: report})
+	}
+	return c.JSON(http.StatusServiceUnavailable, &Result{Success: false, Data: report})
+}
@@ -0,0 +1,153 @@
+package loong
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestHealth(t *testing.T) {
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "http",
+		ListenAt: "127.0.0.1:0",
+	}
+
+	var dbErr error
+	var dbCalls int
+
+	e := New()
+	e.Health.AddRunner("runner", r)
+	e.Health.Register("db", func(ctx context.Context) error {
+		dbCalls++
+		return dbErr
+	}, time.Second, time.Hour)
+	e.Health.Register("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}, 10*time.Millisecond, 0)
+	e.Health.Unregister("slow")
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/internal/healthz"); code != http.StatusOK {
+		t.Error("healthz: want 200 got", code)
+	}
+	if code := get("/internal/readyz"); code != http.StatusServiceUnavailable {
+		t.Error("readyz before start: want 503 got", code)
+	}
+
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if code := get("/internal/readyz"); code != http.StatusOK {
+		t.Error("readyz after start: want 200 got", code)
+	}
+
+	// 结果被缓存了, 所以不会立即变为失败
+	dbErr = errors.New("db is down")
+	if code := get("/internal/readyz"); code != http.StatusOK {
+		t.Error("readyz with cache: want 200 got", code)
+	}
+	if dbCalls != 1 {
+		t.Error("want 1 got", dbCalls)
+	}
+
+	if err := r.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+	if code := get("/internal/readyz"); code != http.StatusServiceUnavailable {
+		t.Error("readyz after stop: want 503 got", code)
+	}
+	if code := get("/internal/healthz"); code != http.StatusOK {
+		t.Error("healthz after stop: want 200 got", code)
+	}
+}
+
+func TestHealthTimeout(t *testing.T) {
+	h := NewHealth()
+	h.RegisterLiveness("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}, 10*time.Millisecond, 0)
+
+	start := time.Now()
+	report, ok := h.Liveness(context.Background())
+	if ok {
+		t.Error("want timeout")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("timeout isnot effective")
+	}
+	if report.Checks["slow"].Status != HealthStatusDown {
+		t.Errorf("want down got %#v", report.Checks["slow"])
+	}
+}
+
+func TestHealthRunnerEngine(t *testing.T) {
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "http",
+		ListenAt: "127.0.0.1:0",
+	}
+
+	// 没有调用 AddRunner, Start 时自动加入
+	e := New()
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	ctx := context.Background()
+	if err := r.Start(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/internal/readyz"); code != http.StatusOK {
+		t.Error("readyz after start: want 200 got", code)
+	}
+	if err := r.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+	if code := get("/internal/readyz"); code != http.StatusServiceUnavailable {
+		t.Error("readyz after stop: want 503 got", code)
+	}
+}
+
+func TestHealthMount(t *testing.T) {
+	e := New()
+	e.DisableHealthRoutes = true
+	e.MountHealth(e.Group("/api/v1"))
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	for path, code := range map[string]int{
+		"/internal/healthz": http.StatusNotFound,
+		"/internal/readyz":  http.StatusNotFound,
+		"/api/v1/healthz":   http.StatusOK,
+		"/api/v1/readyz":    http.StatusOK,
+	} {
+		if c := get(path); c != code {
+			t.Error(path, ": want", code, "got", c)
+		}
+	}
+}
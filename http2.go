@@ -0,0 +1,108 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/runner-mei/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP2Config 是 http2 的参数, 为 0 的字段使用 golang.org/x/net/http2 的默认值
+//
+//	Disable   禁用 https 和 tlcp 上的 http2 (ALPN 只协商 http/1.1)
+//	H2C       在明文的端点 (http, unix 和 auto 模式下的明文连接) 上支持 h2c,
+//	          包括 prior knowledge 和 Upgrade: h2c 两种方式
+//	IdleTimeout, ReadIdleTimeout, PingTimeout, WriteByteTimeout 见 http2.Server
+type HTTP2Config struct {
+	Disable bool
+	H2C     bool
+
+	MaxConcurrentStreams         uint32
+	MaxReadFrameSize             uint32
+	MaxUploadBufferPerConnection int32
+	MaxUploadBufferPerStream     int32
+	IdleTimeout                  time.Duration
+	ReadIdleTimeout              time.Duration
+	PingTimeout                  time.Duration
+	WriteByteTimeout             time.Duration
+}
+
+func (c *HTTP2Config) server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams:         c.MaxConcurrentStreams,
+		MaxReadFrameSize:             c.MaxReadFrameSize,
+		MaxUploadBufferPerConnection: c.MaxUploadBufferPerConnection,
+		MaxUploadBufferPerStream:     c.MaxUploadBufferPerStream,
+		IdleTimeout:                  c.IdleTimeout,
+		ReadIdleTimeout:              c.ReadIdleTimeout,
+		PingTimeout:                  c.PingTimeout,
+		WriteByteTimeout:             c.WriteByteTimeout,
+	}
+}
+
+func (c *HTTP2Config) nextProtos() []string {
+	if c.Disable {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+// setupHTTP2 在 http.Server 上启用或禁用 http2, 明文的端点在 H2C 为 true 时启用 h2c
+func (es *endpointServer) setupHTTP2() error {
+	if es.isHTTPs {
+		if es.HTTP2.Disable {
+			// TLSNextProto 不为 nil 时 http.Server 不会自动启用 http2
+			es.srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		} else {
+			es.h2s = es.HTTP2.server()
+			if err := http2.ConfigureServer(es.srv, es.h2s); err != nil {
+				return err
+			}
+		}
+	}
+
+	if es.HTTP2.H2C && (!es.isHTTPs || es.isAuto) {
+		if es.h2s == nil {
+			// h2c 的连接是被 Hijack 的, 要通过 ConfigureServer 在 Shutdown 时通知它们关闭
+			es.h2s = es.HTTP2.server()
+			if err := http2.ConfigureServer(es.srv, es.h2s); err != nil {
+				return err
+			}
+		}
+		es.srv.Handler = h2c.NewHandler(es.srv.Handler, es.h2s)
+	}
+	return nil
+}
+
+// handleTlcpConn 在 tlcp 连接上协商了 h2 时直接用 http2 服务它, 因为 http.Server
+// 只会对 *tls.Conn 使用 TLSNextProto。返回 nil 表示连接已经被处理了
+func (es *endpointServer) handleTlcpConn(conn net.Conn, logger log.Logger) net.Conn {
+	if es.h2s == nil {
+		return conn
+	}
+
+	conn.SetDeadline(time.Now().Add(AutoDetectTimeout))
+	proto, err := tlcpHandshake(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		logger.Info("tlcp handshake fail", log.Stringer("addr", conn.RemoteAddr()), log.Error(err))
+		conn.Close()
+		return nil
+	}
+	if proto != http2.NextProtoTLS {
+		return conn
+	}
+
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, conn.LocalAddr())
+	go es.h2s.ServeConn(conn, &http2.ServeConnOpts{
+		Context:    autoConnContext(ctx, conn),
+		BaseConfig: es.srv,
+		Handler:    es.srv.Handler,
+	})
+	return nil
+}
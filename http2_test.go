@@ -0,0 +1,128 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+	"golang.org/x/net/http2"
+)
+
+func TestRunnerH2C(t *testing.T) {
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "http",
+		ListenAt: "127.0.0.1:0",
+		HTTP2:    HTTP2Config{H2C: true, MaxConcurrentStreams: 10},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, strconv.Itoa(req.ProtoMajor))
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	u, _ := r.URL()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	response, err := client.Get(u)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bs, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bs) != "2" {
+		t.Error("want 2 got", string(bs))
+	}
+
+	// 普通的 http/1.1 客户端不受影响
+	response, err = http.Get(u)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bs, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bs) != "1" {
+		t.Error("want 1 got", string(bs))
+	}
+}
+
+func TestRunnerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certFile, keyFile, 1, time.Now().Add(time.Hour))
+
+	for _, test := range []struct {
+		config HTTP2Config
+		proto  int
+	}{
+		{config: HTTP2Config{}, proto: 2},
+		{config: HTTP2Config{MaxReadFrameSize: 1 << 20, IdleTimeout: time.Minute}, proto: 2},
+		{config: HTTP2Config{Disable: true}, proto: 1},
+	} {
+		r := &Runner{
+			Logger:   logtest.NewLogger(t),
+			Network:  "https",
+			ListenAt: "127.0.0.1:0",
+			KeyFile:  keyFile,
+			CertFile: certFile,
+			HTTP2:    test.config,
+		}
+		ctx := context.Background()
+		err := r.Start(ctx, http.NotFoundHandler())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		u, _ := r.URL()
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		response, err := client.Get(u)
+		if err != nil {
+			t.Error(err)
+		} else {
+			response.Body.Close()
+			if response.ProtoMajor != test.proto {
+				t.Error("want", test.proto, "got", response.ProtoMajor)
+			}
+		}
+		r.Stop(ctx)
+	}
+
+	// http2 要求的密码套件不存在时在 Start 时返回错误
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "https",
+		ListenAt: "127.0.0.1:0",
+		KeyFile:  keyFile,
+		CertFile: certFile,
+		TLS: TLSConfig{
+			MaxVersion:   "tls12",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA"},
+		},
+	}
+	if err := r.Start(context.Background(), http.NotFoundHandler()); err == nil {
+		r.Stop(context.Background())
+		t.Error("want error got ok")
+	}
+}
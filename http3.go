@@ -0,0 +1,139 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mei-rune/ipfilter"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+// HTTP3Config 是 http3 (quic) 的参数, 仅在 Network 为 h3/quic 时有效, 为 0 的
+// 字段使用 quic-go 的默认值
+//
+//	MaxIdleTimeout     连接上没有任何数据的最长时间, 超过后关闭连接
+//	KeepAlivePeriod    发送 PING 的间隔, 为 0 时不发送, 在 NAT 后面的设备可能需要它
+//	MaxIncomingStreams 每个连接上最多并发的请求数
+type HTTP3Config struct {
+	MaxIdleTimeout     time.Duration
+	KeepAlivePeriod    time.Duration
+	MaxIncomingStreams int64
+}
+
+// HTTP3Options 是创建 HTTP3Server 的参数, Conn 是和 tls 端点相同端口的 udp socket,
+// http3 和 tcp 上的 http.Server 使用同一个 handler 和同一个 tls.Config
+type HTTP3Options struct {
+	Conn           net.PacketConn
+	TLSConfig      *tls.Config
+	Config         HTTP3Config
+	MaxHeaderBytes int
+	Handler        http.Handler
+
+	// Filter 不为空时拒绝它不允许的地址的连接, 并调用 OnBlocked
+	Filter    *ipfilter.IPFilter
+	OnBlocked func(addr net.Addr)
+}
+
+// HTTP3Server 是 http3 的服务, 它的实现在 github.com/runner-mei/loong/h3 中,
+// 这样没有使用 http3 的程序不用依赖 quic-go
+type HTTP3Server interface {
+	// AltSvc 在 tcp 上的响应中加上 Alt-Svc 头, 通知客户端可以改用 http3
+	AltSvc(handler http.Handler) http.Handler
+
+	// Serve 一直运行到 Shutdown 或 Close, 这时返回 http.ErrServerClosed
+	Serve() error
+
+	// Shutdown 等待正在处理的请求完成后关闭所有的连接和 Conn
+	Shutdown(ctx context.Context) error
+
+	// Close 立即关闭所有的连接和 Conn
+	Close() error
+}
+
+var newHTTP3Server func(opts HTTP3Options) (HTTP3Server, error)
+
+// RegisterHTTP3 注册 http3 的实现, 导入 github.com/runner-mei/loong/h3 时会
+// 自动注册, 没有注册时 Network 不能为 h3/quic
+func RegisterHTTP3(newServer func(opts HTTP3Options) (HTTP3Server, error)) {
+	newHTTP3Server = newServer
+}
+
+type http3Server struct {
+	inheritKey string
+	conn       net.PacketConn
+	srv        HTTP3Server
+	logger     log.Logger
+}
+
+// listenHTTP3 监听和 tls 端点相同的 udp 地址, 端口可能是通过 CandidatePortStart
+// 动态分配的, 所以要用实际监听的地址
+func (es *endpointServer) listenHTTP3(handler http.Handler) error {
+	if !es.isH3 {
+		return nil
+	}
+
+	key := inheritKey(es.Name, "/h3")
+	conn, ok, err := takeInheritPacketConn(key)
+	if !ok {
+		conn, err = net.ListenPacket("udp", es.listener.Addr().String())
+	}
+	if err != nil {
+		return errors.Wrap(err, "http3: listen at '"+es.listener.Addr().String()+"' fail")
+	}
+
+	hs := &http3Server{inheritKey: key, conn: conn, logger: log.Empty()}
+	opts := HTTP3Options{
+		Conn:           conn,
+		TLSConfig:      es.tlsConfig,
+		Config:         es.HTTP3,
+		MaxHeaderBytes: es.Limits.maxHeaderBytes(),
+		Handler:        handler,
+	}
+	if o := es.IPFilterOptions; !o.TrustProxy && (len(o.AllowedIPs) != 0 || len(o.BlockedIPs) != 0 || o.BlockByDefault) {
+		blocked := connBlockedTotal.WithLabelValues(conn.LocalAddr().String())
+		opts.Filter = ipfilter.New(o)
+		opts.OnBlocked = func(addr net.Addr) {
+			blocked.Inc()
+			if o.Logger != nil {
+				o.Logger.Printf("ip is blocked: addr = %s", addr)
+			} else {
+				hs.logger.Info("ip is blocked", log.Stringer("addr", addr))
+			}
+		}
+	}
+
+	hs.srv, err = newHTTP3Server(opts)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "http3: listen at '"+conn.LocalAddr().String()+"' fail")
+	}
+	es.h3 = hs
+	return nil
+}
+
+func (hs *http3Server) serve(logger log.Logger) {
+	hs.logger = logger
+	logger.Info("http3 listen at: udp+" + hs.conn.LocalAddr().String())
+
+	err := hs.srv.Serve()
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("http3 server start unsuccessful", log.Error(err))
+	}
+}
+
+func (hs *http3Server) shutdown(ctx context.Context) error {
+	err := hs.srv.Shutdown(ctx)
+	if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+		err = nil
+	}
+	return err
+}
+
+func (hs *http3Server) close() {
+	hs.srv.Close()
+}
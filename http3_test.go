@@ -0,0 +1,31 @@
+package loong
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestRunnerHTTP3Unregistered(t *testing.T) {
+	if newHTTP3Server != nil {
+		t.Skip("http3 is registered")
+	}
+
+	r := &Runner{
+		Logger:     logtest.NewLogger(t),
+		Network:    "h3",
+		ListenAt:   "127.0.0.1:0",
+		SelfSigned: SelfSignedConfig{Dir: t.TempDir()},
+	}
+	err := r.Start(context.Background(), http.NotFoundHandler())
+	if err == nil {
+		r.Stop(context.Background())
+		t.Fatal("want error got ok")
+	}
+	if !strings.Contains(err.Error(), "github.com/runner-mei/loong/h3") {
+		t.Error("want import hint got", err)
+	}
+}
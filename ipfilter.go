@@ -0,0 +1,71 @@
+package loong
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mei-rune/ipfilter"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+var ErrIPBlocked = errors.NewHTTPError(http.StatusForbidden, "ip is blocked")
+
+// IPFilter 是可以热更新规则的 ipfilter, 它用于 IPFilterMiddleware, 和 Runner 中在
+// listener 上的 ipfilter 不同, 它检查的是 Context.ClientIP (即经过可信代理转发时
+// 的真实客户端地址), 所以 Options 中的 TrustProxy 被忽略。和 listener 上的一样,
+// 来自本机的请求总是允许的
+type IPFilter struct {
+	opts   atomic.Pointer[ipfilter.Options]
+	filter atomic.Pointer[ipfilter.IPFilter]
+}
+
+func NewIPFilter(opts ipfilter.Options) *IPFilter {
+	f := &IPFilter{}
+	f.Update(opts)
+	return f
+}
+
+// Update 替换过滤规则, 正在处理的请求不受影响
+func (f *IPFilter) Update(opts ipfilter.Options) {
+	f.opts.Store(&opts)
+	f.filter.Store(ipfilter.New(opts))
+}
+
+// Options 返回当前的过滤规则
+func (f *IPFilter) Options() ipfilter.Options {
+	return *f.opts.Load()
+}
+
+// Allowed 判断 ip 是否被允许, 无效的 ip 总是被拒绝
+func (f *IPFilter) Allowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if addr.IsLoopback() {
+		return true
+	}
+	return f.filter.Load().NetAllowed(addr)
+}
+
+// IPFilterMiddleware 返回一个按客户端 ip 过滤请求的 middleware, 它可以用于
+// Party 或者单个路由, 被拒绝的请求返回 403
+func IPFilterMiddleware(filter *IPFilter) MiddlewareFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if filter == nil {
+				return next(c)
+			}
+
+			ip := c.ClientIP()
+			if filter.Allowed(ip) {
+				return next(c)
+			}
+
+			c.logger().Info("ip is blocked", log.String("ip", ip))
+			return c.returnResultError(ErrIPBlocked, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package loong
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mei-rune/ipfilter"
+)
+
+func TestIPFilterMiddleware(t *testing.T) {
+	ops := NewIPFilter(ipfilter.Options{AllowedIPs: []string{"10.1.0.0/16"}, BlockByDefault: true})
+
+	e := New()
+	e.TrustedProxies, _ = NewTrustedProxies("192.168.0.1")
+	e.InternalIPFilter = ops
+	e.GET("/api/hello", func(c *Context) error {
+		return c.String(http.StatusOK, "hello")
+	})
+	admin := e.Group("/admin", IPFilterMiddleware(ops))
+	admin.GET("/hello", func(c *Context) error {
+		return c.String(http.StatusOK, "hello")
+	})
+
+	do := func(path, remoteAddr, xff string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set(HeaderXForwardedFor, xff)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, test := range []struct {
+		path       string
+		remoteAddr string
+		xff        string
+		code       int
+	}{
+		{"/api/hello", "1.2.3.4:1234", "", http.StatusOK},
+		{"/admin/hello", "1.2.3.4:1234", "", http.StatusForbidden},
+		{"/admin/hello", "10.1.2.3:1234", "", http.StatusOK},
+		{"/admin/hello", "127.0.0.1:1234", "", http.StatusOK},
+		// 经过可信的代理时检查的是真实的客户端地址
+		{"/admin/hello", "192.168.0.1:1234", "10.1.2.3", http.StatusOK},
+		{"/admin/hello", "192.168.0.1:1234", "1.2.3.4", http.StatusForbidden},
+		// 不可信的客户端伪造的 X-Forwarded-For 不生效
+		{"/admin/hello", "1.2.3.4:1234", "10.1.2.3", http.StatusForbidden},
+		{"/internal/routeinfo", "1.2.3.4:1234", "", http.StatusForbidden},
+		{"/internal/routeinfo", "10.1.2.3:1234", "", http.StatusOK},
+		{"/internal/metrics", "1.2.3.4:1234", "", http.StatusForbidden},
+		{"/internal/healthz", "1.2.3.4:1234", "", http.StatusOK},
+	} {
+		rec := do(test.path, test.remoteAddr, test.xff)
+		if rec.Code != test.code {
+			t.Error(test.path, test.remoteAddr, test.xff, "want", test.code, "got", rec.Code, rec.Body.String())
+			continue
+		}
+		if rec.Code == http.StatusForbidden {
+			var result Result
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Error(err)
+			} else if result.Success || result.Error == nil {
+				t.Error("want error result got", rec.Body.String())
+			}
+		}
+	}
+
+	// 规则是热更新的
+	ops.Update(ipfilter.Options{AllowedIPs: []string{"1.2.3.4"}, BlockByDefault: true})
+	if rec := do("/admin/hello", "1.2.3.4:1234", ""); rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+	if rec := do("/admin/hello", "10.1.2.3:1234", ""); rec.Code != http.StatusForbidden {
+		t.Error("want 403 got", rec.Code)
+	}
+	if opts := ops.Options(); len(opts.AllowedIPs) != 1 || opts.AllowedIPs[0] != "1.2.3.4" {
+		t.Error("options is", opts)
+	}
+}
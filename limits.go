@@ -0,0 +1,187 @@
+package loong
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/runner-mei/log"
+)
+
+// 下面是 LimitsConfig 中为 0 的字段的默认值
+var (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultMaxHeaderBytes    = http.DefaultMaxHeaderBytes
+	DefaultTCPKeepAlive      = 3 * time.Minute
+)
+
+// LimitsConfig 是 http.Server 的超时和限制, 为 0 的字段使用上面的默认值, 小于 0
+// 时不限制 (TCPKeepAlive 小于 0 时禁用 keepalive)
+//
+//	ReadHeaderTimeout 读取请求头的最长时间, 用于防止 slowloris
+//	ReadTimeout       读取整个请求 (包括 body) 的最长时间, 默认不限制, 以免大文件上传失败
+//	WriteTimeout      写响应的最长时间, 默认不限制, 以免 SSE 和大文件下载失败
+//	IdleTimeout       keep-alive 的连接在两个请求之间的最长空闲时间
+//	MaxHeaderBytes    请求头的最大字节数
+//	TCPKeepAlive      tcp keepalive 的间隔
+//	MaxConnections    同时打开的最大连接数 (包括被 Hijack 的连接), 达到后不再 Accept,
+//	                  新连接在内核的队列中等待, 直到有连接关闭, 为 0 时不限制
+type LimitsConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	TCPKeepAlive      time.Duration
+	MaxConnections    int
+}
+
+func limitDuration(value, defaultValue time.Duration) time.Duration {
+	if value == 0 {
+		return defaultValue
+	}
+	if value < 0 {
+		return 0
+	}
+	return value
+}
+
+// configure 设置 http.Server 的超时和限制
+func (c *LimitsConfig) configure(srv *http.Server) {
+	srv.ReadHeaderTimeout = limitDuration(c.ReadHeaderTimeout, DefaultReadHeaderTimeout)
+	srv.ReadTimeout = limitDuration(c.ReadTimeout, 0)
+	srv.WriteTimeout = limitDuration(c.WriteTimeout, 0)
+	srv.IdleTimeout = limitDuration(c.IdleTimeout, DefaultIdleTimeout)
+	srv.MaxHeaderBytes = c.maxHeaderBytes()
+}
+
+func (c *LimitsConfig) maxHeaderBytes() int {
+	if c.MaxHeaderBytes == 0 {
+		return DefaultMaxHeaderBytes
+	}
+	if c.MaxHeaderBytes < 0 {
+		// http.Server 的 MaxHeaderBytes 为 0 时使用 http.DefaultMaxHeaderBytes
+		return 1<<31 - 1
+	}
+	return c.MaxHeaderBytes
+}
+
+func (c *LimitsConfig) keepAlivePeriod() time.Duration {
+	if c.TCPKeepAlive == 0 {
+		return DefaultTCPKeepAlive
+	}
+	return c.TCPKeepAlive
+}
+
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (ln keepAliveListener) Accept() (net.Conn, error) {
+	tc, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if ln.period < 0 {
+		tc.SetKeepAlive(false)
+	} else {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(ln.period)
+	}
+	return tc, nil
+}
+
+// limitListener 在打开的连接数达到 max 时停止 Accept, 直到有连接关闭, 见
+// golang.org/x/net/netutil.LimitListener, 不同的是在开始等待时记录日志
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	limited   atomic.Bool
+	onLimited func()
+}
+
+func newLimitListener(ln net.Listener, max int, onLimited func()) net.Listener {
+	return &limitListener{
+		Listener:  ln,
+		sem:       make(chan struct{}, max),
+		done:      make(chan struct{}),
+		onLimited: onLimited,
+	}
+}
+
+func (ln *limitListener) acquire() bool {
+	select {
+	case ln.sem <- struct{}{}:
+		ln.limited.Store(false)
+		return true
+	default:
+	}
+
+	// 只在每次开始达到上限时通知一次, 以免日志太多
+	if ln.limited.CompareAndSwap(false, true) {
+		ln.onLimited()
+	}
+	select {
+	case ln.sem <- struct{}{}:
+		return true
+	case <-ln.done:
+		return false
+	}
+}
+
+func (ln *limitListener) release() {
+	<-ln.sem
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	if !ln.acquire() {
+		return nil, net.ErrClosed
+	}
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		ln.release()
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: ln.release}, nil
+}
+
+func (ln *limitListener) Close() error {
+	err := ln.Listener.Close()
+	ln.closeOnce.Do(func() { close(ln.done) })
+	return err
+}
+
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// wrapLimits 设置 tcp keepalive 和最大连接数
+func (es *endpointServer) wrapLimits(listener net.Listener, logger log.Logger) net.Listener {
+	listenAt := listener.Addr().String()
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		listener = keepAliveListener{TCPListener: tcpListener, period: es.Limits.keepAlivePeriod()}
+	}
+	if es.Limits.MaxConnections > 0 {
+		limited := connLimitedTotal.WithLabelValues(listenAt)
+		listener = newLimitListener(listener, es.Limits.MaxConnections, func() {
+			limited.Inc()
+			logger.Warn("too many connections, wait for some of them to close",
+				log.String("listener", listenAt), log.Int("max_connections", es.Limits.MaxConnections))
+		})
+	}
+	return listener
+}
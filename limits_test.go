@@ -0,0 +1,116 @@
+package loong
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestLimitsConfig(t *testing.T) {
+	srv := &http.Server{}
+	config := LimitsConfig{}
+	config.configure(srv)
+	if srv.ReadHeaderTimeout != DefaultReadHeaderTimeout ||
+		srv.IdleTimeout != DefaultIdleTimeout ||
+		srv.MaxHeaderBytes != DefaultMaxHeaderBytes ||
+		srv.ReadTimeout != 0 || srv.WriteTimeout != 0 {
+		t.Error("defaults are not applied", srv.ReadHeaderTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	}
+
+	config = LimitsConfig{ReadHeaderTimeout: -1, ReadTimeout: time.Minute, WriteTimeout: 2 * time.Minute, IdleTimeout: -1}
+	config.configure(srv)
+	if srv.ReadHeaderTimeout != 0 || srv.IdleTimeout != 0 ||
+		srv.ReadTimeout != time.Minute || srv.WriteTimeout != 2*time.Minute {
+		t.Error("limits are not applied", srv.ReadHeaderTimeout, srv.IdleTimeout, srv.ReadTimeout, srv.WriteTimeout)
+	}
+}
+
+func TestRunnerReadHeaderTimeout(t *testing.T) {
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "http",
+		ListenAt: "127.0.0.1:0",
+		Limits:   LimitsConfig{ReadHeaderTimeout: 100 * time.Millisecond},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	addr, _ := r.ListenAddr()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	// 请求头一直没有发送完, 服务端要在 ReadHeaderTimeout 后关闭连接
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Error("connection isnot closed by server, elapsed", elapsed)
+	}
+}
+
+func TestRunnerMaxConnections(t *testing.T) {
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "http",
+		ListenAt: "127.0.0.1:0",
+		Limits:   LimitsConfig{MaxConnections: 1},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	addr, _ := r.ListenAddr()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	u, _ := r.URL()
+	done := make(chan error, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		response, err := client.Get(u)
+		if err == nil {
+			response.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Error("request should wait for the first connection to close", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("request is still blocked after the first connection is closed")
+	}
+}
@@ -39,6 +39,43 @@ type Context struct {
 	WrapOkResult    func(c *Context, code int, i interface{}) interface{}
 	WrapErrorResult func(c *Context, code int, err error) interface{}
 	LogArray        []string
+
+	trustedProxies *TrustedProxies
+}
+
+// ClientIP 返回客户端的 ip, 只有直接连接的对端是可信的代理时才使用 Forwarded 和
+// X-Forwarded-For 等头, 见 Engine.TrustedProxies
+func (c *Context) ClientIP() string {
+	return c.proxies().ClientIP(c.Request())
+}
+
+// RealIP 和 ClientIP 相同, 它覆盖了 echo.Context.RealIP
+func (c *Context) RealIP() string {
+	return c.ClientIP()
+}
+
+// Scheme 返回客户端请求的 scheme, 只有对端是可信的代理时才使用 X-Forwarded-Proto
+// 和 Forwarded 中的 proto, 它覆盖了 echo.Context.Scheme
+func (c *Context) Scheme() string {
+	return c.proxies().Scheme(c.Request())
+}
+
+// Host 返回客户端请求的 host, 只有对端是可信的代理时才使用 X-Forwarded-Host 和
+// Forwarded 中的 host
+func (c *Context) Host() string {
+	return c.proxies().Host(c.Request())
+}
+
+// BaseURL 返回客户端访问本服务时的 scheme 和 host, 如 https://example.com, 用于生成 URL
+func (c *Context) BaseURL() string {
+	return c.Scheme() + "://" + c.Host()
+}
+
+func (c *Context) proxies() *TrustedProxies {
+	if c.trustedProxies != nil {
+		return c.trustedProxies
+	}
+	return DefaultTrustedProxies
 }
 
 func (c *Context) QueryParamArray(name string) []string {
@@ -118,6 +155,27 @@ func (c *Context) ReturnError(err error, code ...int) error {
 	return c.JSON(httpCode, ToHTTPError(err, httpCode))
 }
 
+// errorResult 返回错误的响应内容, 没有设置 WrapErrorResult 时也使用 Result 的格式
+func (c *Context) errorResult(err error, code int) interface{} {
+	if c.WrapErrorResult != nil {
+		return c.WrapErrorResult(c, code, err)
+	}
+	return &Result{Success: false, Error: ToHTTPError(err, code)}
+}
+
+// returnResultError 是中间件拒绝请求时使用的, 它和 ReturnError 不同的是没有设置
+// WrapErrorResult 时也返回 Result
+func (c *Context) returnResultError(err error, code int) error {
+	return c.JSON(code, c.errorResult(err, code))
+}
+
+func (c *Context) logger() log.Logger {
+	if c.CtxLogger != nil {
+		return c.CtxLogger
+	}
+	return log.LoggerOrEmptyFromContext(c.StdContext)
+}
+
 var _ echo.Context = &Context{}
 
 // HandlerFunc defines a function to serve HTTP requests.
@@ -179,7 +237,9 @@ const (
 	HeaderUpgrade             = echo.HeaderUpgrade
 	HeaderVary                = echo.HeaderVary
 	HeaderWWWAuthenticate     = echo.HeaderWWWAuthenticate
+	HeaderForwarded           = "Forwarded"
 	HeaderXForwardedFor       = echo.HeaderXForwardedFor
+	HeaderXForwardedHost      = "X-Forwarded-Host"
 	HeaderXForwardedProto     = echo.HeaderXForwardedProto
 	HeaderXForwardedProtocol  = echo.HeaderXForwardedProtocol
 	HeaderXForwardedSsl       = echo.HeaderXForwardedSsl
@@ -269,6 +329,21 @@ type Engine struct {
 	WrapOkResult    func(c *Context, code int, i interface{}) interface{}
 	WrapErrorResult func(c *Context, code int, err error) interface{}
 
+	// TrustedProxies 是可信的反向代理, 为 nil 时使用 DefaultTrustedProxies, 见 Context.ClientIP
+	TrustedProxies *TrustedProxies
+
+	// InternalIPFilter 限制 /internal/routeinfo 和 /internal/metrics 只能从指定的
+	// 网络访问, 为 nil 时不限制, 见 IPFilterMiddleware
+	InternalIPFilter *IPFilter
+
+	// Health 是 /internal/healthz 和 /internal/readyz 使用的健康检测, Runner.Start
+	// 会自动将 Runner 的状态加入 readiness 检测
+	Health *Health
+
+	// DisableHealthRoutes 为 true 时 /internal/healthz 和 /internal/readyz 返回 404,
+	// 这时可以用 MountHealth 将它们注册到其它的路径下
+	DisableHealthRoutes bool
+
 	noRoutes []struct {
 		prefix  string
 		handler HandlerFunc
@@ -645,6 +720,7 @@ func toContext(e *Engine, ctx echo.Context) *Context {
 		StdContext:      req.Context(),
 		WrapOkResult:    e.WrapOkResult,
 		WrapErrorResult: e.WrapErrorResult,
+		trustedProxies:  e.TrustedProxies,
 	}
 	if e.Logger != nil {
 		actx.CtxLogger = e.Logger.With(log.String("http.method", req.Method), log.Stringer("http.url", req.URL))
@@ -689,7 +765,17 @@ func (engine *Engine) EnalbeSwaggerAt(prefix, instanceName string) {
 
 func New() *Engine {
 	e := &Engine{
-		Echo: echo.New(),
+		Echo:   echo.New(),
+		Health: NewHealth(),
+	}
+
+	// echo 的 c.RealIP() 和 middleware.Logger 中的 remote_ip 也使用 TrustedProxies
+	e.Echo.IPExtractor = func(req *http.Request) string {
+		proxies := e.TrustedProxies
+		if proxies == nil {
+			proxies = DefaultTrustedProxies
+		}
+		return proxies.ClientIP(req)
 	}
 
 	// 这里没有用 middleware.RemoveTrailingSlash() 是因为它会修改 req.RequestURI, 而我不希望被修改
@@ -764,7 +850,8 @@ func New() *Engine {
 
 	// Middleware
 	e.Echo.Use(middleware.Logger())
-	e.Echo.Use(middleware.Recover())
+	e.Use(Metrics())
+	e.Use(Recover())
 
 	e.Echo.HTTPErrorHandler = echo.HTTPErrorHandler(func(err error, c echo.Context) {
 		if err == echo.ErrNotFound {
@@ -830,15 +917,44 @@ func New() *Engine {
 		e.Echo.DefaultHTTPErrorHandler(err, c)
 	})
 
+	// InternalIPFilter 可能是在 New 之后设置的, 所以在处理请求时才读取它
+	internalOnly := func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			return IPFilterMiddleware(e.InternalIPFilter)(next)(c)
+		}
+	}
+
 	docHandler := func(c echo.Context) error {
 		return c.JSON(http.StatusOK, Result{Success: true, Data: e.Echo.Routes()})
 	}
 	doc := e.Echo.Group("/internal").Group("/routeinfo")
-	doc.Any("*", docHandler)
-	doc.GET("", docHandler)
+	doc.Any("*", docHandler, e.convertMiddleware(internalOnly))
+	doc.GET("", docHandler, e.convertMiddleware(internalOnly))
+
+	e.Echo.GET("/internal/metrics", echo.WrapHandler(MetricsHandler()), e.convertMiddleware(internalOnly))
+	// healthz 和 readyz 由 kubelet 或负载均衡访问, 不受 InternalIPFilter 的限制
+	e.MountHealth(e.Group("/internal"), func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if e.DisableHealthRoutes {
+				return ErrNotFound
+			}
+			return next(c)
+		}
+	})
 	return e
 }
 
+// MountHealth 在 party 下注册 /healthz (liveness) 和 /readyz (readiness)
+func (e *Engine) MountHealth(party Party, m ...MiddlewareFunc) {
+	// Health 可能是在 New 之后替换的, 所以在处理请求时才读取它
+	party.GET("/healthz", func(c *Context) error {
+		return e.Health.LivenessHandler()(c)
+	}, m...)
+	party.GET("/readyz", func(c *Context) error {
+		return e.Health.ReadinessHandler()(c)
+	}, m...)
+}
+
 func WrapHandler(handler http.Handler) HandlerFunc {
 	return func(c *Context) error {
 		handler.ServeHTTP(c.Response(), c.Request())
@@ -0,0 +1,179 @@
+package loong
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/runner-mei/errors"
+)
+
+var (
+	// MetricsRegisterer 和 MetricsGatherer 必须在第一次调用 New() 或 Runner.Start() 之前修改
+	MetricsRegisterer prometheus.Registerer = prometheus.DefaultRegisterer
+	MetricsGatherer   prometheus.Gatherer   = prometheus.DefaultGatherer
+
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_server_requests_total",
+		Help: "Total number of HTTP requests by route, method and status class.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_server_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route, method and status class.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+	httpResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_server_response_size_bytes",
+		Help:    "Size of HTTP responses by route, method and status class.",
+		Buckets: prometheus.ExponentialBuckets(128, 4, 8),
+	}, []string{"route", "method", "code"})
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_server_requests_in_flight",
+		Help: "Number of HTTP requests currently being served.",
+	})
+
+	connAcceptedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_server_connections_accepted_total",
+		Help: "Total number of connections accepted by the listener.",
+	}, []string{"listener"})
+	connActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_server_connections_active",
+		Help: "Number of connections currently open on the listener.",
+	}, []string{"listener"})
+	connBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_server_connections_blocked_total",
+		Help: "Total number of connections rejected by the ipfilter.",
+	}, []string{"listener"})
+	connLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_server_connections_limited_total",
+		Help: "Total number of times the listener stopped accepting because the max connections was reached.",
+	}, []string{"listener"})
+
+	concurrencyLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_server_concurrency_limit",
+		Help: "Current adaptive concurrency limit of the limiter.",
+	}, []string{"limiter"})
+	concurrencyInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_server_concurrency_in_flight",
+		Help: "Number of requests currently admitted by the limiter.",
+	}, []string{"limiter"})
+	concurrencyShedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_server_requests_shed_total",
+		Help: "Total number of requests rejected by the concurrency limiter by priority.",
+	}, []string{"limiter", "priority"})
+
+	registerMetricsOnce sync.Once
+)
+
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		MetricsRegisterer.MustRegister(
+			httpRequestsTotal,
+			httpRequestDuration,
+			httpResponseSize,
+			httpRequestsInFlight,
+			connAcceptedTotal,
+			connActive,
+			connBlockedTotal,
+			connLimitedTotal,
+			concurrencyLimit,
+			concurrencyInFlight,
+			concurrencyShedTotal,
+		)
+	})
+}
+
+// MetricsHandler returns the handler which exposes the metrics in Prometheus text format.
+func MetricsHandler() http.Handler {
+	registerMetrics()
+	return promhttp.HandlerFor(MetricsGatherer, promhttp.HandlerOpts{})
+}
+
+// Metrics returns a middleware which records the request metrics, it is labelled
+// by the route pattern instead of the raw path to keep the cardinality low.
+func Metrics() MiddlewareFunc {
+	registerMetrics()
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			httpRequestsInFlight.Inc()
+			defer httpRequestsInFlight.Dec()
+
+			start := time.Now()
+			err := next(c)
+
+			route := c.Path()
+			if route == "" {
+				route = "<unmatched>"
+			}
+			code := statusClass(responseStatus(c, err))
+			method := c.Request().Method
+
+			httpRequestsTotal.WithLabelValues(route, method, code).Inc()
+			httpRequestDuration.WithLabelValues(route, method, code).Observe(time.Since(start).Seconds())
+			httpResponseSize.WithLabelValues(route, method, code).Observe(float64(c.Response().Size))
+			return err
+		}
+	}
+}
+
+// responseStatus 返回响应的状态码, handler 返回错误且还没有写响应时是错误对应的状态码
+func responseStatus(c *Context, err error) int {
+	status := c.Response().Status
+	if err != nil && !c.Response().Committed {
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		} else {
+			status = errors.HTTPCode(err, http.StatusInternalServerError)
+		}
+	}
+	return status
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return strconv.Itoa(status)
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func wrapMetricsListener(ln net.Listener, name string) net.Listener {
+	registerMetrics()
+	return &metricsListener{
+		Listener: ln,
+		accepted: connAcceptedTotal.WithLabelValues(name),
+		active:   connActive.WithLabelValues(name),
+	}
+}
+
+type metricsListener struct {
+	net.Listener
+	accepted prometheus.Counter
+	active   prometheus.Gauge
+}
+
+func (ln *metricsListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ln.accepted.Inc()
+	ln.active.Inc()
+	return &metricsConn{Conn: conn, active: ln.active}, nil
+}
+
+type metricsConn struct {
+	net.Conn
+	active prometheus.Gauge
+	once   sync.Once
+}
+
+func (c *metricsConn) Close() error {
+	c.once.Do(c.active.Dec)
+	return c.Conn.Close()
+}
@@ -0,0 +1,44 @@
+package loong
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	e := New()
+	e.GET("/users/:id", func(c *Context) error {
+		return c.String(http.StatusOK, c.Param("id"))
+	})
+
+	for _, id := range []string{"1", "2", "3"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/"+id, nil))
+		if rec.Code != http.StatusOK {
+			t.Error("want 200 got", rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/internal/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+		return
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`http_server_requests_total{code="2xx",method="GET",route="/users/:id"} 3`,
+		`http_server_request_duration_seconds_count{code="2xx",method="GET",route="/users/:id"} 3`,
+		`http_server_requests_in_flight`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Error("want", want)
+		}
+	}
+	if strings.Contains(body, `route="/users/1"`) {
+		t.Error("raw path is used as label")
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/runner-mei/errors"
 	"github.com/runner-mei/log"
 )
 
@@ -33,7 +35,19 @@ func Tracing(tracer opentracing.Tracer, comp string, traceAll bool) MiddlewareFu
 			} else {
 				span = tracer.StartSpan(comp+":"+req.URL.Path, opentracing.ChildOf(wireContext))
 			}
-			defer span.Finish()
+			// Recover 在 Tracing 的外层 (如 New() 中的 Recover 和 Use 注册的 Tracing)
+			// 时, 它处理 panic 时 span 已经结束了, 所以这里先记录 panic 再继续向外抛出。
+			// SetTracing 是通过 Pre 注册的, 这时 Tracing 在 Recover 的外层, 不会收到 panic
+			defer func() {
+				if r := recover(); r != nil {
+					ext.Error.Set(span, true)
+					ext.HTTPStatusCode.Set(span, uint16(http.StatusInternalServerError))
+					span.LogFields(otlog.String("event", "panic"), otlog.Error(errors.Recover(r)))
+					span.Finish()
+					panic(r)
+				}
+				span.Finish()
+			}()
 
 			c.StdContext = opentracing.ContextWithSpan(c.StdContext, span)
 
@@ -41,6 +55,9 @@ func Tracing(tracer opentracing.Tracer, comp string, traceAll bool) MiddlewareFu
 			ext.SpanKind.Set(span, ext.SpanKindRPCServerEnum)
 			ext.HTTPUrl.Set(span, c.Request().Host+c.Request().RequestURI)
 			ext.HTTPMethod.Set(span, c.Request().Method)
+			if id := RequestIDFromContext(c.StdContext); id != "" {
+				span.SetTag(SpanTagRequestID, id)
+			}
 
 			if c.CtxLogger != nil {
 				c.CtxLogger = c.CtxLogger.WithTargets(log.OutputToTracer(log.DefaultSpanLevel, span))
@@ -48,7 +65,7 @@ func Tracing(tracer opentracing.Tracer, comp string, traceAll bool) MiddlewareFu
 			}
 
 			err = next(c)
-			if err != nil {
+			if err != nil || c.Response().Status >= http.StatusInternalServerError {
 				ext.Error.Set(span, true)
 			} else {
 				ext.Error.Set(span, false)
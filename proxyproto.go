@@ -0,0 +1,271 @@
+package loong
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+// DefaultProxyProtocolTimeout 是等待 PROXY 协议头的默认时间
+var DefaultProxyProtocolTimeout = 10 * time.Second
+
+// ProxyProtocolConfig 是 PROXY 协议 (HAProxy 定义的 v1 文本格式和 v2 二进制格式)
+// 的参数, TrustedCIDRs 不为空时启用。只有来源地址在 TrustedCIDRs 中的连接才会解析
+// PROXY 协议头, 解析出的客户端地址作为连接的 RemoteAddr, 所以 ipfilter、
+// http.Request.RemoteAddr 和 RealIP 看到的都是真实的客户端地址
+//
+//	TrustedCIDRs 负载均衡的地址, 如 10.0.0.0/8, 单个 ip 也可以
+//	Required     为 true 时来自 TrustedCIDRs 的连接必须有 PROXY 协议头, 否则关闭连接
+//	Timeout      等待 PROXY 协议头的时间, 为 0 时使用 DefaultProxyProtocolTimeout
+type ProxyProtocolConfig struct {
+	TrustedCIDRs []string
+	Required     bool
+	Timeout      time.Duration
+}
+
+func (c *ProxyProtocolConfig) IsEnabled() bool {
+	return len(c.TrustedCIDRs) > 0
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("cidr '" + s + "' is invalid")
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "cidr '"+s+"' is invalid")
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocol 解析 PROXY 协议头
+type proxyProtocol struct {
+	trusted  []*net.IPNet
+	required bool
+	timeout  time.Duration
+}
+
+func newProxyProtocol(config ProxyProtocolConfig) (*proxyProtocol, error) {
+	trusted, err := parseCIDRs(config.TrustedCIDRs)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy protocol")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProxyProtocolTimeout
+	}
+	return &proxyProtocol{
+		trusted:  trusted,
+		required: config.Required,
+		timeout:  timeout,
+	}, nil
+}
+
+// wrap 在单独的 goroutine 中读取 PROXY 协议头, 以免慢的连接阻塞 Accept
+func (p *proxyProtocol) wrap(ln net.Listener, logger log.Logger) net.Listener {
+	return newAsyncListener(ln, func(conn net.Conn) net.Conn {
+		c, err := p.handle(conn)
+		if err != nil {
+			logger.Warn("read proxy protocol header fail, close connection",
+				log.Stringer("addr", conn.RemoteAddr()), log.Error(err))
+			conn.Close()
+			return nil
+		}
+		return c
+	})
+}
+
+func (p *proxyProtocol) handle(conn net.Conn) (net.Conn, error) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !containsIP(p.trusted, addr.IP) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	br := bufio.NewReader(conn)
+	src, dst, found, err := readProxyHeader(br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if !found && p.required {
+		return nil, errors.New("proxy protocol header is missing")
+	}
+
+	pc := &proxyConn{peekConn: &peekConn{Conn: conn, r: br}}
+	if src != nil {
+		pc.remoteAddr = src
+		pc.localAddr = dst
+	}
+	return pc, nil
+}
+
+// proxyConn 是通过 PROXY 协议转发的连接, RemoteAddr 和 LocalAddr 是协议头中的地址
+type proxyConn struct {
+	*peekConn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader 读取 PROXY 协议头, found 为 false 表示没有协议头 (br 中的数据
+// 没有被消费), src 为 nil 表示协议头中没有地址 (如 v1 的 UNKNOWN 和 v2 的 LOCAL)
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, found bool, err error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, false, nil
+		}
+		return nil, nil, false, err
+	}
+
+	switch first[0] {
+	case 'P':
+		hdr, err := br.Peek(6)
+		if err != nil || string(hdr) != "PROXY " {
+			return nil, nil, false, nil
+		}
+		src, dst, err = readProxyV1(br)
+		return src, dst, true, err
+	case '\r':
+		hdr, err := br.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(hdr, proxyV2Signature) {
+			return nil, nil, false, nil
+		}
+		src, dst, err = readProxyV2(br)
+		return src, dst, true, err
+	default:
+		return nil, nil, false, nil
+	}
+}
+
+// readProxyV1 读取 v1 的协议头, 如 "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+// 它最长为 107 个字节
+func readProxyV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read proxy protocol v1 header fail")
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy protocol v1 header is invalid")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("proxy protocol v1 header '" + string(line[:len(line)-2]) + "' is invalid")
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil ||
+		(fields[1] == "TCP4") != (srcIP.To4() != nil) {
+		return nil, nil, errors.New("proxy protocol v1 header '" + string(line[:len(line)-2]) + "' is invalid")
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 读取 v2 的协议头, 它由 12 个字节的签名, 版本和命令, 地址族和协议,
+// 两个字节的长度和地址组成, 地址后面的 TLV 被忽略
+func readProxyV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, nil, errors.Wrap(err, "read proxy protocol v2 header fail")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, errors.New("proxy protocol version '" + strconv.Itoa(int(hdr[12]>>4)) + "' is unsupported")
+	}
+	command := hdr[12] & 0x0f
+	family := hdr[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, errors.Wrap(err, "read proxy protocol v2 header fail")
+	}
+
+	switch command {
+	case 0x0: // LOCAL, 如负载均衡的健康检查, 使用连接本身的地址
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, errors.New("proxy protocol v2 command '" + strconv.Itoa(int(command)) + "' is unsupported")
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, nil, errors.New("proxy protocol v2 address is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, nil, errors.New("proxy protocol v2 address is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}, nil
+	default:
+		// UNSPEC、UDP 和 unix socket 的地址对 http 没有意义, 使用连接本身的地址
+		return nil, nil, nil
+	}
+}
@@ -0,0 +1,234 @@
+package loong
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mei-rune/ipfilter"
+	"github.com/runner-mei/log/logtest"
+)
+
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x21, 0x11, 0, 12)
+	hdr = append(hdr, src.IP.To4()...)
+	hdr = append(hdr, dst.IP.To4()...)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(src.Port))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(dst.Port))
+	return hdr
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, test := range []struct {
+		input  string
+		src    string
+		found  bool
+		hasErr bool
+	}{
+		{input: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n", src: "192.168.0.1:56324", found: true},
+		{input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET / HTTP/1.1\r\n", src: "[2001:db8::1]:56324", found: true},
+		{input: "PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n", found: true},
+		{input: string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443})) + "GET / HTTP/1.1\r\n", src: "10.1.2.3:1234", found: true},
+		{input: "GET / HTTP/1.1\r\n"},
+		{input: "POST / HTTP/1.1\r\n"},
+		{input: "PROXY TCP4 192.168.0.1\r\nGET / HTTP/1.1\r\n", found: true, hasErr: true},
+		{input: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", found: true, hasErr: true},
+		{input: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443" + strings.Repeat(" ", 100), found: true, hasErr: true},
+	} {
+		br := bufio.NewReader(strings.NewReader(test.input))
+		src, _, found, err := readProxyHeader(br)
+		if test.hasErr {
+			if err == nil {
+				t.Error(test.input, "want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.input, err)
+			continue
+		}
+		if found != test.found {
+			t.Error(test.input, "want found", test.found, "got", found)
+		}
+		if test.src == "" {
+			if src != nil {
+				t.Error(test.input, "want no address got", src)
+			}
+		} else if src == nil || src.String() != test.src {
+			t.Error(test.input, "want", test.src, "got", src)
+		}
+
+		// 协议头之后的数据不能丢失
+		rest, _ := io.ReadAll(br)
+		if !strings.HasSuffix(string(rest), " / HTTP/1.1\r\n") {
+			t.Error(test.input, "rest is", string(rest))
+		}
+	}
+}
+
+func TestRunnerProxyProtocol(t *testing.T) {
+	r := &Runner{
+		Logger:          logtest.NewLogger(t),
+		Network:         "http",
+		ListenAt:        "127.0.0.1:0",
+		ProxyProtocol:   ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.0/8"}},
+		IPFilterOptions: ipfilter.Options{BlockedIPs: []string{"10.9.9.9"}},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.RemoteAddr+","+RealIP(req))
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	addr, _ := r.ListenAddr()
+	do := func(header []byte) (string, error) {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write(header)
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		bs, err := io.ReadAll(response.Body)
+		return string(bs), err
+	}
+
+	body, err := do([]byte("PROXY TCP4 192.168.1.10 127.0.0.1 56324 80\r\n"))
+	if err != nil {
+		t.Error(err)
+	} else if body != "192.168.1.10:56324,192.168.1.10" {
+		t.Error("got", body)
+	}
+
+	body, err = do(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.168.1.11"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}))
+	if err != nil {
+		t.Error(err)
+	} else if body != "192.168.1.11:1234,192.168.1.11" {
+		t.Error("got", body)
+	}
+
+	// 没有协议头时使用连接本身的地址
+	body, err = do(nil)
+	if err != nil {
+		t.Error(err)
+	} else if !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Error("got", body)
+	}
+
+	// ipfilter 检查的是协议头中的地址
+	_, err = do([]byte("PROXY TCP4 10.9.9.9 127.0.0.1 56324 80\r\n"))
+	if err == nil {
+		t.Error("want blocked")
+	}
+}
+
+func TestRunnerProxyProtocolRequired(t *testing.T) {
+	r := &Runner{
+		Logger:        logtest.NewLogger(t),
+		Network:       "http",
+		ListenAt:      "127.0.0.1:0",
+		ProxyProtocol: ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.1"}, Required: true},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	u, _ := r.URL()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	response, err := client.Get(u)
+	if err == nil {
+		response.Body.Close()
+		t.Error("want error")
+	}
+
+	r2 := &Runner{
+		Logger:        logtest.NewLogger(t),
+		Network:       "http",
+		ListenAt:      "127.0.0.1:0",
+		ProxyProtocol: ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.1/40"}},
+	}
+	if err := r2.Start(ctx, http.NotFoundHandler()); err == nil {
+		r2.Stop(ctx)
+		t.Error("want error")
+	}
+}
+
+func TestRunnerProxyProtocolRedirect(t *testing.T) {
+	dir, err := os.MkdirTemp("", "loong-proxy-redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Runner{
+		Logger:        logtest.NewLogger(t),
+		Network:       "https",
+		ListenAt:      "127.0.0.1:0",
+		SelfSigned:    SelfSignedConfig{Dir: dir},
+		RedirectHTTP:  RedirectHTTPConfig{ListenAt: "127.0.0.1:0"},
+		ProxyProtocol: ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.1"}, Required: true},
+	}
+	ctx := context.Background()
+	err = r.Start(ctx, http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	port, _ := r.ListenPort()
+	addr := r.servers[0].redirect.listener.Addr().String()
+	do := func(header string) (*http.Response, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		io.WriteString(conn, header+"GET /a HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	response, err := do("PROXY TCP4 192.168.1.10 127.0.0.1 56324 80\r\n")
+	if err != nil {
+		t.Error(err)
+	} else {
+		response.Body.Close()
+		if response.StatusCode != http.StatusPermanentRedirect {
+			t.Error("want 308 got", response.StatusCode)
+		}
+		if location := response.Header.Get("Location"); location != "https://example.com:"+port+"/a" {
+			t.Error("location is", location)
+		}
+	}
+
+	// Required 时没有协议头的连接被关闭
+	if response, err := do(""); err == nil {
+		response.Body.Close()
+		t.Error("want error")
+	}
+}
@@ -0,0 +1,564 @@
+package loong
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+var ErrRateLimited = errors.NewHTTPError(http.StatusTooManyRequests, "too many requests")
+
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitSlidingWindow = "sliding_window"
+)
+
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRateLimitPolicy    = "RateLimit-Policy"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// RateLimitRule 是限流的规则, 每个 Period 内最多允许 Limit 个请求。
+//
+// token_bucket 算法中桶的容量是 Burst (为 0 时等于 Limit), 令牌以 Limit/Period
+// 的速度补充; sliding_window 算法用当前窗口和上一个窗口的计数按时间加权来估算
+// 最近一个 Period 内的请求数。
+type RateLimitRule struct {
+	Algorithm string
+	Limit     int
+	Period    time.Duration
+	Burst     int
+}
+
+func (rule *RateLimitRule) capacity() float64 {
+	if rule.Algorithm == RateLimitTokenBucket && rule.Burst > 0 {
+		return float64(rule.Burst)
+	}
+	return float64(rule.Limit)
+}
+
+// rate 是每毫秒补充的令牌数
+func (rule *RateLimitRule) rate() float64 {
+	return float64(rule.Limit) / float64(rule.Period.Milliseconds())
+}
+
+// RateLimitResult 是一次请求的限流结果
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Reset 是额度完全恢复 (token_bucket) 或者当前窗口结束 (sliding_window) 的时间
+	Reset time.Duration
+
+	// RetryAfter 是被拒绝时需要等待的时间
+	RetryAfter time.Duration
+}
+
+func tokenBucketRefill(tokens float64, last, now int64, exists bool, rule *RateLimitRule) float64 {
+	capacity := rule.capacity()
+	if !exists {
+		return capacity
+	}
+	if now > last {
+		tokens += float64(now-last) * rule.rate()
+	}
+	return math.Min(capacity, tokens)
+}
+
+func tokenBucketResult(allowed bool, tokens float64, rule *RateLimitRule) RateLimitResult {
+	rate := rule.rate()
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((rule.capacity()-tokens)/rate) * time.Millisecond,
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration(math.Ceil((1-tokens)/rate)) * time.Millisecond
+	}
+	return result
+}
+
+// slidingWindowWeight 返回上一个窗口的计数在估算中的权重
+func slidingWindowWeight(elapsed time.Duration, rule *RateLimitRule) float64 {
+	return 1 - float64(elapsed)/float64(rule.Period)
+}
+
+func slidingWindowResult(allowed bool, prev, curr int64, elapsed time.Duration, rule *RateLimitRule) RateLimitResult {
+	limit := float64(rule.Limit)
+	count := float64(prev)*slidingWindowWeight(elapsed, rule) + float64(curr)
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: int(math.Max(0, math.Floor(limit-count))),
+		Reset:     rule.Period - elapsed,
+	}
+	if !allowed {
+		if float64(curr)+1 <= limit {
+			// 等上一个窗口的权重降下来
+			need := 1 - (limit-1-float64(curr))/float64(prev)
+			result.RetryAfter = time.Duration(need*float64(rule.Period)) - elapsed
+		} else {
+			// 等到下一个窗口, 那时当前窗口成为上一个窗口
+			need := 1 - (limit-1)/float64(curr)
+			result.RetryAfter = rule.Period - elapsed + time.Duration(need*float64(rule.Period))
+		}
+		if result.RetryAfter < time.Millisecond {
+			result.RetryAfter = time.Millisecond
+		}
+	}
+	return result
+}
+
+// RateLimitStore 保存限流的状态, 它必须是并发安全的, 多个实例共享一个 store
+// (如 RedisRateLimitStore) 时限流是全局的
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (RateLimitResult, error)
+}
+
+type memoryRateLimitEntry struct {
+	// token_bucket
+	tokens float64
+	last   int64
+
+	// sliding_window
+	window     int64
+	prev, curr int64
+
+	expireAt int64
+}
+
+// MemoryRateLimitStore 是保存在内存中的 RateLimitStore, 过期的状态会定期清理
+type MemoryRateLimitStore struct {
+	lock      sync.Mutex
+	entries   map[string]*memoryRateLimitEntry
+	lastSweep int64
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{entries: map[string]*memoryRateLimitEntry{}}
+}
+
+const rateLimitSweepInterval = int64(time.Minute / time.Millisecond)
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (RateLimitResult, error) {
+	ms := now.UnixMilli()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ms-s.lastSweep > rateLimitSweepInterval {
+		for k, entry := range s.entries {
+			if entry.expireAt < ms {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = ms
+	}
+
+	entry, exists := s.entries[key]
+	if exists && entry.expireAt < ms {
+		exists = false
+	}
+	if !exists {
+		entry = &memoryRateLimitEntry{}
+		s.entries[key] = entry
+	}
+
+	if rule.Algorithm == RateLimitSlidingWindow {
+		period := rule.Period.Milliseconds()
+		window := ms / period
+		if entry.window != window {
+			if entry.window == window-1 {
+				entry.prev = entry.curr
+			} else {
+				entry.prev = 0
+			}
+			entry.curr = 0
+			entry.window = window
+		}
+		elapsed := time.Duration(ms-window*period) * time.Millisecond
+
+		allowed := float64(entry.prev)*slidingWindowWeight(elapsed, &rule)+float64(entry.curr)+1 <= float64(rule.Limit)
+		if allowed {
+			entry.curr++
+		}
+		entry.expireAt = (window + 2) * period
+		return slidingWindowResult(allowed, entry.prev, entry.curr, elapsed, &rule), nil
+	}
+
+	tokens := tokenBucketRefill(entry.tokens, entry.last, ms, exists, &rule)
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	entry.tokens = tokens
+	if ms > entry.last {
+		entry.last = ms
+	}
+	entry.expireAt = ms + int64(math.Ceil(rule.capacity()/rule.rate()))
+	return tokenBucketResult(allowed, tokens, &rule), nil
+}
+
+// RedisScripter 是 RedisRateLimitStore 需要的 redis 命令, 任何兼容 redis 的客户端
+// 都可以适配它, 如 go-redis 可以这样:
+//
+//	loong.RedisEvalFunc(func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return client.Eval(ctx, script, keys, args...).Result()
+//	})
+type RedisScripter interface {
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+type RedisEvalFunc func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+
+func (f RedisEvalFunc) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(ctx, script, keys, args...)
+}
+
+// 脚本的计算和 MemoryRateLimitStore 一致, 时间由调用者传入, 所以各个实例的时钟需要同步
+const redisTokenBucketScript = `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil then
+  tokens = capacity
+  last = now
+elseif now > last then
+  tokens = math.min(capacity, tokens + (now - last) * rate)
+  last = now
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(last))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {allowed, tostring(tokens)}
+`
+
+const redisSlidingWindowScript = `
+local limit = tonumber(ARGV[1])
+local weight = tonumber(ARGV[2])
+local curr = tonumber(redis.call('GET', KEYS[1]) or '0')
+local prev = tonumber(redis.call('GET', KEYS[2]) or '0')
+local allowed = 0
+if prev * weight + curr + 1 <= limit then
+  curr = redis.call('INCR', KEYS[1])
+  redis.call('PEXPIRE', KEYS[1], ARGV[3])
+  allowed = 1
+end
+return {allowed, prev, curr}
+`
+
+// RedisRateLimitStore 是保存在 redis 中的 RateLimitStore, 每次 Take 执行一个 lua 脚本。
+//
+// key 的格式为:
+//
+//	token_bucket    prefix{key}           hash, 字段为 tokens 和 last
+//	sliding_window  prefix{key}:window    当前窗口和上一个窗口的计数
+//
+// {key} 是 redis cluster 的 hash tag, 它保证 sliding_window 的脚本用到的两个 key
+// 在同一个 slot 中, 否则会返回 CROSSSLOT 错误
+type RedisRateLimitStore struct {
+	client RedisScripter
+	prefix string
+}
+
+func NewRedisRateLimitStore(client RedisScripter, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client, prefix: prefix}
+}
+
+func (s *RedisRateLimitStore) redisKey(key string) string {
+	return s.prefix + "{" + key + "}"
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (RateLimitResult, error) {
+	ms := now.UnixMilli()
+
+	if rule.Algorithm == RateLimitSlidingWindow {
+		period := rule.Period.Milliseconds()
+		window := ms / period
+		elapsed := time.Duration(ms-window*period) * time.Millisecond
+
+		keys := []string{
+			s.redisKey(key) + ":" + strconv.FormatInt(window, 10),
+			s.redisKey(key) + ":" + strconv.FormatInt(window-1, 10),
+		}
+		reply, err := s.client.Eval(ctx, redisSlidingWindowScript, keys,
+			rule.Limit,
+			strconv.FormatFloat(slidingWindowWeight(elapsed, &rule), 'f', -1, 64),
+			2*period)
+		if err != nil {
+			return RateLimitResult{}, errors.Wrap(err, "rate limit")
+		}
+		values, err := redisReplyInts(reply, 3)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return slidingWindowResult(values[0] == 1, values[1], values[2], elapsed, &rule), nil
+	}
+
+	reply, err := s.client.Eval(ctx, redisTokenBucketScript, []string{s.redisKey(key)},
+		strconv.FormatFloat(rule.capacity(), 'f', -1, 64),
+		strconv.FormatFloat(rule.rate(), 'f', -1, 64),
+		ms,
+		int64(math.Ceil(rule.capacity()/rule.rate())))
+	if err != nil {
+		return RateLimitResult{}, errors.Wrap(err, "rate limit")
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return RateLimitResult{}, errors.New("rate limit: unexpected reply '" + fmt.Sprint(reply) + "'")
+	}
+	allowed, err := redisReplyInt(values[0])
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	tokens, err := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+	if err != nil {
+		return RateLimitResult{}, errors.New("rate limit: unexpected reply '" + fmt.Sprint(reply) + "'")
+	}
+	return tokenBucketResult(allowed == 1, tokens, &rule), nil
+}
+
+func redisReplyInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			return i, nil
+		}
+	case []byte:
+		i, err := strconv.ParseInt(string(v), 10, 64)
+		if err == nil {
+			return i, nil
+		}
+	}
+	return 0, errors.New("rate limit: unexpected reply '" + fmt.Sprint(value) + "'")
+}
+
+func redisReplyInts(reply interface{}, n int) ([]int64, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != n {
+		return nil, errors.New("rate limit: unexpected reply '" + fmt.Sprint(reply) + "'")
+	}
+	results := make([]int64, n)
+	for idx := range values {
+		i, err := redisReplyInt(values[idx])
+		if err != nil {
+			return nil, err
+		}
+		results[idx] = i
+	}
+	return results, nil
+}
+
+// RateLimitKeyFunc 返回请求的身份, 返回空字符串时请求不受限制
+type RateLimitKeyFunc func(c *Context) string
+
+// RateLimitByIP 按客户端的 ip 限流, 经过可信的代理时是真实的客户端地址
+func RateLimitByIP(c *Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// RateLimitByUser 按 UserFromContext 中的用户限流, 用户必须是 string 或者实现了
+// fmt.Stringer, 否则需要自己提供 RateLimitKeyFunc。值为 nil 的指针当作没有用户
+func RateLimitByUser(c *Context) string {
+	switch u := UserFromContext(c.StdContext).(type) {
+	case string:
+		if u != "" {
+			return "user:" + u
+		}
+	case *CertificateIdentity:
+		if u != nil {
+			return "user:" + u.Subject.String()
+		}
+	case fmt.Stringer:
+		// 接口中可能是一个值为 nil 的指针, 调用 String() 会 panic
+		if v := reflect.ValueOf(u); v.Kind() != reflect.Ptr || !v.IsNil() {
+			return "user:" + u.String()
+		}
+	}
+	return ""
+}
+
+// RateLimitByJWTSubject 按 TokenFromContext 中 jwt 的 sub 限流
+func RateLimitByJWTSubject(c *Context) string {
+	token, ok := TokenFromContext(c.StdContext).(*jwt.Token)
+	if !ok || token == nil {
+		return ""
+	}
+
+	var subject string
+	switch claims := token.Claims.(type) {
+	case *jwt.StandardClaims:
+		subject = claims.Subject
+	case *jwt.RegisteredClaims:
+		subject = claims.Subject
+	case jwt.MapClaims:
+		subject, _ = claims["sub"].(string)
+	}
+	if subject == "" {
+		return ""
+	}
+	return "sub:" + subject
+}
+
+// RateLimitByAPIKey 按请求头中的 api key 限流, header 为空时是 X-API-Key, 保存的
+// 是 api key 的 hash 值, 不会泄露到 store 中
+func RateLimitByAPIKey(header string) RateLimitKeyFunc {
+	if header == "" {
+		header = HeaderXAPIKey
+	}
+	return func(c *Context) string {
+		key := c.Request().Header.Get(header)
+		if key == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(key))
+		return "apikey:" + hex.EncodeToString(sum[:16])
+	}
+}
+
+// RateLimitKeys 依次调用 fns, 返回第一个不为空的身份, 如
+// RateLimitKeys(RateLimitByUser, RateLimitByIP) 对登录的用户按用户限流, 其它按 ip 限流
+func RateLimitKeys(fns ...RateLimitKeyFunc) RateLimitKeyFunc {
+	return func(c *Context) string {
+		for _, fn := range fns {
+			if key := fn(c); key != "" {
+				return key
+			}
+		}
+		return ""
+	}
+}
+
+const HeaderXAPIKey = "X-API-Key"
+
+// RateLimitConfig defines the config for RateLimit middleware.
+type RateLimitConfig struct {
+	RateLimitRule
+
+	// Name 区分不同的限流器, 为空时是路由的路径, 即每个路由单独计数, 多个路由
+	// 使用相同的 Name 时共享额度
+	Name string
+
+	// KeyFunc 返回请求的身份, 默认是 RateLimitByIP
+	KeyFunc RateLimitKeyFunc
+
+	// Store 默认是 NewMemoryRateLimitStore(), 多个中间件可以共享一个 store
+	Store RateLimitStore
+
+	// Skipper 返回 true 时请求不受限制
+	Skipper func(c *Context) bool
+}
+
+// RateLimit returns a middleware which allows limit requests per period for each
+// client ip with the token bucket algorithm.
+func RateLimit(limit int, period time.Duration) MiddlewareFunc {
+	return RateLimitWithConfig(RateLimitConfig{
+		RateLimitRule: RateLimitRule{Limit: limit, Period: period},
+	})
+}
+
+// RateLimitWithConfig 和 NewRateLimiter 一样, 但是配置不正确时 panic, 适用于
+// 配置写在代码中的情况
+func RateLimitWithConfig(config RateLimitConfig) MiddlewareFunc {
+	mw, err := NewRateLimiter(config)
+	if err != nil {
+		panic(err)
+	}
+	return mw
+}
+
+// NewRateLimiter 返回一个限流的 middleware, 它可以用于 Party 或者单个路由,
+// 响应中带有 RateLimit-* 头, 被拒绝的请求返回 429 和 Retry-After 头。store 出错时
+// 记录日志并放行请求。配置来自配置文件时用它, 配置不正确时返回错误
+func NewRateLimiter(config RateLimitConfig) (MiddlewareFunc, error) {
+	switch config.Algorithm {
+	case "":
+		config.Algorithm = RateLimitTokenBucket
+	case RateLimitTokenBucket, RateLimitSlidingWindow:
+	default:
+		return nil, errors.New("rate limit: unknown algorithm '" + config.Algorithm + "'")
+	}
+	if config.Limit <= 0 || config.Period < time.Millisecond {
+		return nil, errors.New("rate limit: limit and period must be positive")
+	}
+	if config.KeyFunc == nil {
+		config.KeyFunc = RateLimitByIP
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryRateLimitStore()
+	}
+
+	policy := strconv.Itoa(config.Limit) + ";w=" + strconv.FormatInt(int64(math.Ceil(config.Period.Seconds())), 10)
+	if config.Algorithm == RateLimitTokenBucket && config.Burst > 0 {
+		policy += ";burst=" + strconv.Itoa(config.Burst)
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if config.Skipper != nil && config.Skipper(c) {
+				return next(c)
+			}
+			id := config.KeyFunc(c)
+			if id == "" {
+				return next(c)
+			}
+			name := config.Name
+			if name == "" {
+				name = c.Path()
+			}
+
+			result, err := config.Store.Take(c.StdContext, name+"|"+id, config.RateLimitRule, time.Now())
+			if err != nil {
+				c.logger().Warn("rate limit store fail", log.String("name", name), log.Error(err))
+				return next(c)
+			}
+
+			header := c.Response().Header()
+			header.Set(HeaderRateLimitLimit, strconv.Itoa(result.Limit))
+			header.Set(HeaderRateLimitRemaining, strconv.Itoa(result.Remaining))
+			header.Set(HeaderRateLimitReset, durationSeconds(result.Reset))
+			header.Set(HeaderRateLimitPolicy, policy)
+			if result.Allowed {
+				return next(c)
+			}
+
+			header.Set(HeaderRetryAfter, durationSeconds(result.RetryAfter))
+
+			c.logger().Info("too many requests", log.String("name", name), log.String("key", id))
+			return c.returnResultError(ErrRateLimited, http.StatusTooManyRequests)
+		}
+	}, nil
+}
+
+// durationSeconds 返回向上取整的秒数
+func durationSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,380 @@
+package loong
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// redisStandIn 在本地用 go 重新实现了限流的脚本, 参数和返回值的格式和 redis 一致。
+// 它并不执行 lua 脚本, 只能测试 key 的格式、参数和返回值的解析以及 CROSSSLOT 的
+// 规则, 它通过了不能说明 lua 脚本是对的。脚本本身只由 TestRedisRateLimitStoreScripts
+// 在真正的 redis 上测试, 所以 CI 必须设置 LOONG_TEST_REDIS
+type redisStandIn struct {
+	lock   sync.Mutex
+	hashes map[string][2]string
+	values map[string]int64
+}
+
+// redisHashTag 返回 redis cluster 中决定 key 的 slot 的部分
+func redisHashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+func (r *redisStandIn) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// 和 redis cluster 一样, 脚本中的 key 必须在同一个 slot 中
+	for _, key := range keys[1:] {
+		if redisHashTag(key) != redisHashTag(keys[0]) {
+			return nil, errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	toFloat := func(v interface{}) float64 {
+		f, _ := strconv.ParseFloat(fmt.Sprint(v), 64)
+		return f
+	}
+
+	switch script {
+	case redisTokenBucketScript:
+		capacity, rate, now := toFloat(args[0]), toFloat(args[1]), toFloat(args[2])
+		tokens, last := capacity, now
+		if state, ok := r.hashes[keys[0]]; ok {
+			tokens, last = toFloat(state[0]), toFloat(state[1])
+			if now > last {
+				tokens = math.Min(capacity, tokens+(now-last)*rate)
+				last = now
+			}
+		}
+		var allowed int64
+		if tokens >= 1 {
+			tokens--
+			allowed = 1
+		}
+		r.hashes[keys[0]] = [2]string{fmt.Sprint(tokens), fmt.Sprint(last)}
+		return []interface{}{allowed, fmt.Sprint(tokens)}, nil
+	case redisSlidingWindowScript:
+		limit, weight := toFloat(args[0]), toFloat(args[1])
+		curr, prev := r.values[keys[0]], r.values[keys[1]]
+		var allowed int64
+		if float64(prev)*weight+float64(curr)+1 <= limit {
+			curr++
+			r.values[keys[0]] = curr
+			allowed = 1
+		}
+		return []interface{}{allowed, prev, curr}, nil
+	}
+	return nil, errors.New("unknown script")
+}
+
+// redisConn 是测试用的最简单的 redis 客户端, 只支持 EVAL
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (r *redisConn) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	cmd := []string{"EVAL", script, strconv.Itoa(len(keys))}
+	cmd = append(cmd, keys...)
+	for _, arg := range args {
+		cmd = append(cmd, fmt.Sprint(arg))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(cmd))
+	for _, s := range cmd {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(s), s)
+	}
+	r.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return r.readReply()
+}
+
+func (r *redisConn) readReply() (interface{}, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		bs := make([]byte, n+2)
+		if _, err := io.ReadFull(r.reader, bs); err != nil {
+			return nil, err
+		}
+		return string(bs[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = r.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.New("unexpected reply '" + line + "'")
+}
+
+func TestRateLimitStores(t *testing.T) {
+	standIn := &redisStandIn{hashes: map[string][2]string{}, values: map[string]int64{}}
+
+	for name, store := range map[string]RateLimitStore{
+		"memory": NewMemoryRateLimitStore(),
+		"redis":  NewRedisRateLimitStore(standIn, "test:"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testRateLimitStore(t, store)
+		})
+	}
+}
+
+// TestRedisRateLimitStoreScripts 在真正的 redis 上执行限流的 lua 脚本, 需要设置
+// 环境变量 LOONG_TEST_REDIS 为 redis 的地址 (如 127.0.0.1:6379)。这是唯一执行
+// lua 脚本的测试, 所以在 CI 中 (设置了环境变量 CI) 没有 LOONG_TEST_REDIS 时失败,
+// 在本地时跳过
+func TestRedisRateLimitStoreScripts(t *testing.T) {
+	addr := os.Getenv("LOONG_TEST_REDIS")
+	if addr == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("LOONG_TEST_REDIS must be set in CI, the redis lua scripts are not tested without it")
+		}
+		t.Skip("LOONG_TEST_REDIS is not set")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 每次使用不同的前缀, 避免读到上次测试留下的 key
+	prefix := "loong-test:" + strconv.FormatInt(time.Now().UnixNano(), 36) + ":"
+	testRateLimitStore(t, NewRedisRateLimitStore(&redisConn{conn: conn, reader: bufio.NewReader(conn)}, prefix))
+}
+
+func testRateLimitStore(t *testing.T, store RateLimitStore) {
+	ctx := context.Background()
+	now := time.UnixMilli(1000000)
+
+	take := func(key string, rule RateLimitRule, at time.Duration) RateLimitResult {
+		result, err := store.Take(ctx, key, rule, now.Add(at))
+		if err != nil {
+			t.Error(err)
+		}
+		return result
+	}
+
+	bucket := RateLimitRule{Algorithm: RateLimitTokenBucket, Limit: 2, Period: time.Second, Burst: 3}
+	for i := 0; i < 3; i++ {
+		if result := take("bucket", bucket, 0); !result.Allowed || result.Remaining != 2-i {
+			t.Error(i, result)
+		}
+	}
+	result := take("bucket", bucket, 0)
+	if result.Allowed || result.RetryAfter != 500*time.Millisecond || result.Reset != 1500*time.Millisecond {
+		t.Error(result)
+	}
+	if result := take("bucket", bucket, 500*time.Millisecond); !result.Allowed || result.Remaining != 0 {
+		t.Error(result)
+	}
+	if result := take("bucket", bucket, 600*time.Millisecond); result.Allowed {
+		t.Error(result)
+	}
+	// 不同的 key 单独计数
+	if result := take("bucket2", bucket, 600*time.Millisecond); !result.Allowed {
+		t.Error(result)
+	}
+
+	window := RateLimitRule{Algorithm: RateLimitSlidingWindow, Limit: 2, Period: time.Second}
+	for i := 0; i < 2; i++ {
+		if result := take("window", window, 0); !result.Allowed || result.Remaining != 1-i {
+			t.Error(i, result)
+		}
+	}
+	result = take("window", window, 0)
+	if result.Allowed || result.Reset != time.Second || result.RetryAfter != 1500*time.Millisecond {
+		t.Error(result)
+	}
+	// 上一个窗口的计数按时间加权
+	if result := take("window", window, time.Second); result.Allowed {
+		t.Error(result)
+	}
+	if result := take("window", window, 1500*time.Millisecond); !result.Allowed || result.Remaining != 0 {
+		t.Error(result)
+	}
+	if result := take("window", window, 3000*time.Millisecond); !result.Allowed || result.Remaining != 1 {
+		t.Error(result)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	e := New()
+	e.GET("/export", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	}, RateLimit(2, time.Minute))
+	e.GET("/export2", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	}, RateLimitWithConfig(RateLimitConfig{
+		RateLimitRule: RateLimitRule{Algorithm: RateLimitSlidingWindow, Limit: 1, Period: time.Minute},
+		KeyFunc:       RateLimitKeys(RateLimitByAPIKey(""), RateLimitByIP),
+	}))
+
+	do := func(path, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set(HeaderXAPIKey, apiKey)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := do("/export", "1.2.3.4:1234", "")
+		if rec.Code != http.StatusOK {
+			t.Error("want 200 got", rec.Code)
+		}
+		if limit := rec.Header().Get(HeaderRateLimitLimit); limit != "2" {
+			t.Error("limit is", limit)
+		}
+		if remaining := rec.Header().Get(HeaderRateLimitRemaining); remaining != strconv.Itoa(1-i) {
+			t.Error("remaining is", remaining)
+		}
+		if policy := rec.Header().Get(HeaderRateLimitPolicy); policy != "2;w=60" {
+			t.Error("policy is", policy)
+		}
+	}
+
+	rec := do("/export", "1.2.3.4:1234", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Error("want 429 got", rec.Code)
+	}
+	if retryAfter := rec.Header().Get(HeaderRetryAfter); retryAfter != "30" {
+		t.Error("retry after is", retryAfter)
+	}
+	var result Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Error(err)
+	} else if result.Success || result.Error == nil || result.Error.Code != http.StatusTooManyRequests {
+		t.Error("want error result got", rec.Body.String())
+	}
+
+	// 按客户端和路由分别计数
+	if rec := do("/export", "1.2.3.5:1234", ""); rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+	if rec := do("/export2", "1.2.3.4:1234", ""); rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+	if rec := do("/export2", "1.2.3.4:1234", ""); rec.Code != http.StatusTooManyRequests {
+		t.Error("want 429 got", rec.Code)
+	}
+	if rec := do("/export2", "1.2.3.4:1234", "abc"); rec.Code != http.StatusOK {
+		t.Error("want 200 got", rec.Code)
+	}
+	if rec := do("/export2", "1.2.3.6:1234", "abc"); rec.Code != http.StatusTooManyRequests {
+		t.Error("want 429 got", rec.Code)
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	for _, rule := range []RateLimitRule{
+		{Algorithm: "abc", Limit: 1, Period: time.Second},
+		{Limit: 0, Period: time.Second},
+		{Limit: 1, Period: 0},
+	} {
+		if _, err := NewRateLimiter(RateLimitConfig{RateLimitRule: rule}); err == nil {
+			t.Error(rule, ": want error got ok")
+		}
+	}
+	if _, err := NewRateLimiter(RateLimitConfig{RateLimitRule: RateLimitRule{Limit: 1, Period: time.Second}}); err != nil {
+		t.Error(err)
+	}
+}
+
+type rateLimitTestUser struct {
+	name string
+}
+
+func (u *rateLimitTestUser) String() string {
+	return u.name
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	c := &Context{StdContext: context.Background()}
+	if key := RateLimitByUser(c); key != "" {
+		t.Error("got", key)
+	}
+	if key := RateLimitByJWTSubject(c); key != "" {
+		t.Error("got", key)
+	}
+
+	c.StdContext = ContextWithUser(c.StdContext, "admin")
+	if key := RateLimitByUser(c); key != "user:admin" {
+		t.Error("got", key)
+	}
+
+	c.StdContext = ContextWithUser(context.Background(), &rateLimitTestUser{name: "tom"})
+	if key := RateLimitByUser(c); key != "user:tom" {
+		t.Error("got", key)
+	}
+	// 值为 nil 的指针不能 panic
+	c.StdContext = ContextWithUser(context.Background(), (*rateLimitTestUser)(nil))
+	if key := RateLimitByUser(c); key != "" {
+		t.Error("got", key)
+	}
+
+	for _, claims := range []jwt.Claims{
+		&jwt.StandardClaims{Subject: "tom"},
+		&jwt.RegisteredClaims{Subject: "tom"},
+		jwt.MapClaims{"sub": "tom"},
+	} {
+		c.StdContext = ContextWithToken(context.Background(), &jwt.Token{Claims: claims})
+		if key := RateLimitByJWTSubject(c); key != "sub:tom" {
+			t.Error("got", key)
+		}
+	}
+}
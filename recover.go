@@ -0,0 +1,98 @@
+package loong
+
+import (
+	"net/http"
+	"runtime"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+// ErrInternalServerError 是 panic 时返回给客户端的错误, panic 的详细信息只记录在日志中
+var ErrInternalServerError = errors.NewHTTPError(http.StatusInternalServerError, "internal server error")
+
+// RecoverConfig defines the config for Recover middleware.
+type RecoverConfig struct {
+	// Size of the stack to be printed, default is 4KB.
+	StackSize int
+
+	// DisableStackAll disables formatting stack traces of all other goroutines
+	// into buffer after the trace for the current goroutine.
+	DisableStackAll bool
+
+	// DisablePrintStack disables printing stack trace.
+	DisablePrintStack bool
+
+	// OnPanic is called after the panic is logged and before the response
+	// is written, it is a hook for crash reporting.
+	OnPanic func(c *Context, err error, stack []byte)
+}
+
+var DefaultRecoverConfig = RecoverConfig{
+	StackSize: 4 << 10, // 4 KB
+}
+
+// Recover returns a middleware which recovers from panics anywhere in the chain,
+// logs the panic and returns ErrInternalServerError in the Result envelope.
+func Recover() MiddlewareFunc {
+	return RecoverWithConfig(DefaultRecoverConfig)
+}
+
+func RecoverWithConfig(config RecoverConfig) MiddlewareFunc {
+	if config.StackSize <= 0 {
+		config.StackSize = DefaultRecoverConfig.StackSize
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) (returnErr error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
+
+				err := errors.Recover(r)
+
+				var stack []byte
+				if !config.DisablePrintStack || config.OnPanic != nil {
+					stack = make([]byte, config.StackSize)
+					stack = stack[:runtime.Stack(stack, !config.DisableStackAll)]
+				}
+
+				logger := c.logger()
+				if config.DisablePrintStack {
+					logger.Error("处理请求时发生 panic", log.Error(err))
+				} else {
+					logger.Error("处理请求时发生 panic", log.Error(err), log.ByteString("stack", stack))
+				}
+
+				if span := opentracing.SpanFromContext(c.StdContext); span != nil {
+					ext.Error.Set(span, true)
+					fields := []otlog.Field{otlog.String("event", "panic"), otlog.Error(err)}
+					if !config.DisablePrintStack {
+						fields = append(fields, otlog.String("stack", string(stack)))
+					}
+					span.LogFields(fields...)
+				}
+
+				if config.OnPanic != nil {
+					config.OnPanic(c, err, stack)
+				}
+
+				if c.Response().Committed {
+					returnErr = err
+					return
+				}
+				returnErr = c.returnResultError(ErrInternalServerError, http.StatusInternalServerError)
+			}()
+
+			return next(c)
+		}
+	}
+}
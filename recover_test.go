@@ -0,0 +1,135 @@
+package loong
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestRecover(t *testing.T) {
+	var panicErr error
+	var panicStack []byte
+
+	e := New()
+	e.Logger = logtest.NewLogger(t)
+	e.WrapOkResult = WrapResult
+	e.WrapErrorResult = WrapErrorResult
+	e.GET("/panic", func(c *Context) error {
+		panic("boom")
+	}, RecoverWithConfig(RecoverConfig{
+		OnPanic: func(c *Context, err error, stack []byte) {
+			panicErr = err
+			panicStack = stack
+		},
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("want 500 got", rec.Code)
+	}
+
+	var result Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Success {
+		t.Error("want success is false")
+	}
+	if result.Error == nil || result.Error.Message != ErrInternalServerError.Error() {
+		t.Errorf("want %q got %#v", ErrInternalServerError.Error(), result.Error)
+	}
+	if strings.Contains(rec.Body.String(), "boom") {
+		t.Error("panic value is sent to the client", rec.Body.String())
+	}
+
+	if panicErr == nil {
+		t.Error("OnPanic isnot called")
+	} else if panicErr.Error() != "boom" {
+		t.Error("want boom got", panicErr)
+	}
+	if len(panicStack) == 0 {
+		t.Error("stack is empty")
+	}
+}
+
+func TestRecoverWithoutWrapErrorResult(t *testing.T) {
+	e := New()
+	e.Logger = logtest.NewLogger(t)
+	e.GET("/panic", func(c *Context) error {
+		var a []int
+		return c.JSON(http.StatusOK, a[1])
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("want 500 got", rec.Code)
+	}
+
+	var result Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Success || result.Error == nil || result.Error.Message != ErrInternalServerError.Error() {
+		t.Errorf("want internal server error got %s", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "index out of range") {
+		t.Error("panic value is sent to the client", rec.Body.String())
+	}
+}
+
+func TestRecoverTracing(t *testing.T) {
+	tracer := mocktracer.New()
+
+	// New() 中的 Recover 在 Tracing 的外层
+	e := New()
+	e.Logger = logtest.NewLogger(t)
+	e.Use(Tracing(tracer, "test", true))
+	e.GET("/panic", func(c *Context) error {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("want 500 got", rec.Code)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatal("want 1 span got", len(spans))
+	}
+	if tag := spans[0].Tag("error"); tag != true {
+		t.Error("error tag is", tag)
+	}
+	if tag := spans[0].Tag("http.status_code"); tag != uint16(http.StatusInternalServerError) {
+		t.Error("status code tag is", tag)
+	}
+	// mocktracer 在 span 结束后仍然接受 tag 和 log, 所以要检查 log 的时间
+	found := false
+	for _, record := range spans[0].Logs() {
+		for _, field := range record.Fields {
+			if field.Key == "event" && field.ValueString == "panic" &&
+				!record.Timestamp.After(spans[0].FinishTime) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Error("panic isnot logged before the span is finished", spans[0].Logs())
+	}
+}
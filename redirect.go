@@ -0,0 +1,134 @@
+package loong
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+// RedirectHTTPConfig 仅在 Network 为 https/tls/tlcp 时有效, ListenAt 不为空时
+// 额外监听一个 http 端口, 将所有请求用 308 重定向到 https 端口
+type RedirectHTTPConfig struct {
+	ListenAt string
+}
+
+// HSTSConfig 仅在 Network 为 https/tls/tlcp 时有效, MaxAge 大于 0 时在 https
+// 的响应中添加 Strict-Transport-Security 头
+type HSTSConfig struct {
+	MaxAge            time.Duration
+	IncludeSubDomains bool
+	Preload           bool
+}
+
+func (c *HSTSConfig) headerValue() string {
+	if c.MaxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.FormatInt(int64(c.MaxAge/time.Second), 10)
+	if c.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if c.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+// WrapHSTS 在 handler 的响应中添加 Strict-Transport-Security 头
+func WrapHSTS(config HSTSConfig, handler http.Handler) http.Handler {
+	value := config.headerValue()
+	if value == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// HTTPSRedirectHandler 将请求重定向到同一个主机的 https 端口, port 为 443 时
+// URL 中省略端口。使用 308 而不是 301 是为了让 POST 等请求保持方法和 body
+func HTTPSRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				host, _, _ = net.SplitHostPort(addr.String())
+			}
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+type redirectServer struct {
+	inheritKey string
+	srv        *http.Server
+	listener   net.Listener
+}
+
+func (es *endpointServer) listenRedirect() error {
+	if !es.isHTTPs || es.RedirectHTTP.ListenAt == "" {
+		return nil
+	}
+
+	// 端口可能是通过 CandidatePortStart 动态分配的, 所以要用实际监听的端口
+	_, port, err := net.SplitHostPort(es.listener.Addr().String())
+	if err != nil {
+		return errors.Wrap(err, "redirect: tls listener has no port")
+	}
+
+	key := inheritKey(es.Name, "/redirect")
+	listenAt, ln, err := listenInherit(key, func() (string, net.Listener, error) {
+		return ListenAtDynamicPort("tcp", es.RedirectHTTP.ListenAt, 0, 0)
+	})
+	if err != nil {
+		return errors.Wrap(err, "redirect: listen at '"+es.RedirectHTTP.ListenAt+"' fail")
+	}
+	es.redirect = &redirectServer{
+		inheritKey: key,
+		srv: &http.Server{
+			Addr:              listenAt,
+			Handler:           HTTPSRedirectHandler(port),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		listener: ln,
+	}
+	return nil
+}
+
+// serve 中的 listener 已经加上了和主端口相同的 ipfilter、最大连接数和 proxy protocol,
+// 负载均衡器通常对两个端口使用相同的配置, 见 endpointServer.wrapListener
+func (rs *redirectServer) serve(listener net.Listener, logger log.Logger) {
+	logger.Info("http redirect listen at: " + rs.listener.Addr().String())
+
+	err := rs.srv.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("http redirect server start unsuccessful", log.Error(err))
+	}
+}
+
+func (rs *redirectServer) shutdown(ctx context.Context) error {
+	err := rs.srv.Shutdown(ctx)
+	if err != nil {
+		err = rs.srv.Close()
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package loong
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mei-rune/ipfilter"
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, test := range []struct {
+		port   string
+		host   string
+		url    string
+		target string
+	}{
+		{port: "8443", host: "example.com", url: "/a/b?c=d", target: "https://example.com:8443/a/b?c=d"},
+		{port: "8443", host: "example.com:8080", url: "/", target: "https://example.com:8443/"},
+		{port: "443", host: "example.com:80", url: "/x", target: "https://example.com/x"},
+		{port: "8443", host: "[::1]:8080", url: "/", target: "https://[::1]:8443/"},
+		{port: "443", host: "[::1]", url: "/", target: "https://[::1]/"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, test.url, nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+		HTTPSRedirectHandler(test.port).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Error("want 308 got", rec.Code)
+		}
+		if location := rec.Header().Get("Location"); location != test.target {
+			t.Error("want", test.target, "got", location)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	handler := WrapHSTS(HSTSConfig{
+		MaxAge:            365 * 24 * time.Hour,
+		IncludeSubDomains: true,
+	}, http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if value := rec.Header().Get("Strict-Transport-Security"); value != "max-age=31536000; includeSubDomains" {
+		t.Error("got", value)
+	}
+
+	rec = httptest.NewRecorder()
+	WrapHSTS(HSTSConfig{}, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if value := rec.Header().Get("Strict-Transport-Security"); value != "" {
+		t.Error("want empty got", value)
+	}
+}
+
+func TestRunnerRedirectHTTP(t *testing.T) {
+	r := &Runner{
+		Logger:       logtest.NewLogger(t),
+		Network:      "https",
+		ListenAt:     "127.0.0.1:0",
+		SelfSigned:   SelfSignedConfig{Dir: t.TempDir()},
+		RedirectHTTP: RedirectHTTPConfig{ListenAt: "127.0.0.1:0"},
+
+		// 重定向端口和主端口使用相同的 proxy protocol 和 ipfilter
+		ProxyProtocol:   ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.0/8"}},
+		IPFilterOptions: ipfilter.Options{BlockedIPs: []string{"10.9.9.9"}},
+	}
+	ctx := context.Background()
+	if err := r.Start(ctx, http.NotFoundHandler()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(ctx)
+
+	addr, _ := r.ListenAddr()
+	_, port, _ := net.SplitHostPort(addr.String())
+	r.lock.Lock()
+	redirectAddr := r.servers[0].redirect.listener.Addr().String()
+	r.lock.Unlock()
+
+	do := func(header string) (*http.Response, error) {
+		conn, err := net.Dial("tcp", redirectAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		io.WriteString(conn, header)
+		io.WriteString(conn, "GET /a?b=c HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil, err
+		}
+		response.Body.Close()
+		return response, nil
+	}
+
+	response, err := do("PROXY TCP4 192.168.1.10 127.0.0.1 56324 80\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusPermanentRedirect {
+		t.Error("want 308 got", response.StatusCode)
+	}
+	// 主端口是动态分配的, Location 中必须是实际的端口
+	target := "https://localhost:" + port + "/a?b=c"
+	if location := response.Header.Get("Location"); location != target {
+		t.Error("want", target, "got", location)
+	}
+
+	if response, err := do("PROXY TCP4 10.9.9.9 127.0.0.1 56324 80\r\n"); err == nil {
+		t.Error("want blocked got", response.StatusCode)
+	}
+}
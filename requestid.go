@@ -0,0 +1,188 @@
+package loong
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/runner-mei/log"
+)
+
+type requestIDKey struct{}
+
+func (*requestIDKey) String() string {
+	return "loong-request-id-key"
+}
+
+var RequestIDKey = &requestIDKey{}
+
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIDKey, id)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	o := ctx.Value(RequestIDKey)
+	if o == nil {
+		return ""
+	}
+	id, _ := o.(string)
+	return id
+}
+
+// RequestIDConfig defines the config for RequestID middleware.
+type RequestIDConfig struct {
+	// Header is the header name of the request id, default is X-Request-ID.
+	Header string
+
+	// Generator creates a new request id when the request has none,
+	// default is NewUUIDv7.
+	Generator func() string
+
+	// Validator checks the request id sent by the client, an invalid id is
+	// replaced by a generated one, default is IsValidRequestID.
+	Validator func(id string) bool
+}
+
+var DefaultRequestIDConfig = RequestIDConfig{
+	Header:    HeaderXRequestID,
+	Generator: NewUUIDv7,
+	Validator: IsValidRequestID,
+}
+
+// RequestID returns a middleware which accepts or creates the request id, and
+// puts it into StdContext, CtxLogger, the active span and the response header.
+func RequestID() MiddlewareFunc {
+	return RequestIDWithConfig(DefaultRequestIDConfig)
+}
+
+func RequestIDWithConfig(config RequestIDConfig) MiddlewareFunc {
+	if config.Header == "" {
+		config.Header = DefaultRequestIDConfig.Header
+	}
+	if config.Generator == nil {
+		config.Generator = DefaultRequestIDConfig.Generator
+	}
+	if config.Validator == nil {
+		config.Validator = DefaultRequestIDConfig.Validator
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			req := c.Request()
+			id := req.Header.Get(config.Header)
+			if id == "" || !config.Validator(id) {
+				id = config.Generator()
+				req.Header.Set(config.Header, id)
+			}
+			c.Response().Header().Set(config.Header, id)
+
+			c.StdContext = ContextWithRequestID(c.StdContext, id)
+			if c.CtxLogger != nil {
+				c.CtxLogger = c.CtxLogger.With(log.String("request_id", id))
+				c.StdContext = log.ContextWithLogger(c.StdContext, c.CtxLogger)
+			}
+			if span := opentracing.SpanFromContext(c.StdContext); span != nil {
+				span.SetTag(SpanTagRequestID, id)
+			}
+			return next(c)
+		}
+	}
+}
+
+const SpanTagRequestID = "request.id"
+
+// IsValidRequestID 检查客户端传来的 request id, 防止有人通过它注入日志
+func IsValidRequestID(id string) bool {
+	if len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewUUIDv7 creates a time-ordered UUID as described in RFC 9562.
+func NewUUIDv7() string {
+	var u [16]byte
+	rand.Read(u[6:])
+
+	ms := uint64(time.Now().UnixMilli())
+	u[0] = byte(ms >> 40)
+	u[1] = byte(ms >> 32)
+	binary.BigEndian.PutUint32(u[2:], uint32(ms))
+
+	u[6] = (u[6] & 0x0f) | 0x70 // version 7
+	u[8] = (u[8] & 0x3f) | 0x80 // variant 10
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID creates a ULID, see https://github.com/ulid/spec
+func NewULID() string {
+	var u [16]byte
+	rand.Read(u[6:])
+
+	ms := uint64(time.Now().UnixMilli())
+	u[0] = byte(ms >> 40)
+	u[1] = byte(ms >> 32)
+	binary.BigEndian.PutUint32(u[2:], uint32(ms))
+
+	// 128 位按每 5 位一组编码成 26 个字符, 最高的 2 位单独成一组
+	hi := binary.BigEndian.Uint64(u[:8])
+	lo := binary.BigEndian.Uint64(u[8:])
+
+	var buf [26]byte
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockfordAlphabet[lo&0x1f]
+		lo = (lo >> 5) | (hi << 59)
+		hi >>= 5
+	}
+	return string(buf[:])
+}
+
+// RequestIDTransport forwards the request id found in the request context
+// to the outgoing request.
+type RequestIDTransport struct {
+	Header    string
+	Transport http.RoundTripper
+}
+
+func (t *RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := t.Header
+	if header == "" {
+		header = HeaderXRequestID
+	}
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if id := RequestIDFromContext(req.Context()); id != "" && req.Header.Get(header) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(header, id)
+	}
+	return transport.RoundTrip(req)
+}
+
+func WrapRequestIDTransport(transport http.RoundTripper) http.RoundTripper {
+	return &RequestIDTransport{Transport: transport}
+}
@@ -0,0 +1,81 @@
+package loong
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(HeaderXRequestID)
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{Transport: WrapRequestIDTransport(nil)}
+
+	e := New()
+	e.Pre(RequestID())
+	e.GET("/id", func(c *Context) error {
+		req, err := http.NewRequestWithContext(c.StdContext, http.MethodGet, upstream.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return c.String(http.StatusOK, RequestIDFromContext(c.StdContext))
+	})
+
+	uuidv7 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/id", nil))
+	id := rec.Header().Get(HeaderXRequestID)
+	if !uuidv7.MatchString(id) {
+		t.Error("want uuidv7 got", id)
+	}
+	if rec.Body.String() != id {
+		t.Error("want", id, "got", rec.Body.String())
+	}
+	if upstreamID != id {
+		t.Error("want", id, "got", upstreamID)
+	}
+
+	for _, test := range []struct {
+		incoming string
+		accepted bool
+	}{
+		{"abc-123", true},
+		{"bad\nid", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/id", nil)
+		req.Header.Set(HeaderXRequestID, test.incoming)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		id := rec.Header().Get(HeaderXRequestID)
+		if test.accepted != (id == test.incoming) {
+			t.Errorf("%q: accepted want %v got %q", test.incoming, test.accepted, id)
+		}
+		if upstreamID != id {
+			t.Error("want", id, "got", upstreamID)
+		}
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	a := NewULID()
+	if !regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`).MatchString(a) {
+		t.Error("invalid ulid", a)
+	}
+	if b := NewULID(); a == b {
+		t.Error("ulid isnot unique", a)
+	}
+}
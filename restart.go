@@ -0,0 +1,328 @@
+package loong
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+// 新进程通过下面的环境变量从旧进程继承监听的 socket:
+//
+//	LOONG_INHERIT_LISTENERS=endpoint://=3,endpoint:///redirect=4,endpoint://admin=5
+//	LOONG_INHERIT_READY_FD=6
+//
+// 其中 LOONG_INHERIT_LISTENERS 的 key 是端点的名称和 socket 的用途 (见 inheritKey),
+// 新进程所有的 OnStart 成功后向 LOONG_INHERIT_READY_FD 写一个字节然后关闭它,
+// 旧进程收到后才开始停止服务。
+const (
+	EnvInheritListeners = "LOONG_INHERIT_LISTENERS"
+	EnvInheritReadyFD   = "LOONG_INHERIT_READY_FD"
+)
+
+// DefaultRestartTimeout 是 Restart 等待新进程就绪的时间
+var DefaultRestartTimeout = time.Minute
+
+var ErrRestartUnsupported = errors.New("restart with listener handoff is unsupported on " + runtime.GOOS)
+
+var (
+	inheritOnce      sync.Once
+	inheritLock      sync.Mutex
+	inheritListeners map[string]*os.File
+	inheritReadyOnce sync.Once
+)
+
+// inheritKey 返回 Restart 时交给新进程的 socket 的名称, 它由端点的名称 (主端点
+// 为空) 和 socket 的用途 (如 /redirect, /h3) 组成。不能使用地址, 多个端点可以
+// 配置相同的地址 (如 127.0.0.1:0 或者相同的 CandidatePort 范围)
+func inheritKey(endpoint, kind string) string {
+	return "endpoint://" + endpoint + kind
+}
+
+func loadInheritListeners() {
+	inheritOnce.Do(func() {
+		value := os.Getenv(EnvInheritListeners)
+		if value == "" {
+			return
+		}
+		os.Unsetenv(EnvInheritListeners)
+
+		inheritListeners = map[string]*os.File{}
+		for _, s := range strings.Split(value, ",") {
+			idx := strings.LastIndex(s, "=")
+			if idx < 0 {
+				continue
+			}
+			fd, err := strconv.Atoi(s[idx+1:])
+			if err != nil {
+				continue
+			}
+			inheritListeners[s[:idx]] = os.NewFile(uintptr(fd), s[:idx])
+		}
+	})
+}
+
+// takeInheritFile 返回从旧进程继承的 socket 文件, 每个 socket 只能被取一次
+func takeInheritFile(key string) (*os.File, bool) {
+	loadInheritListeners()
+
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+
+	f, ok := inheritListeners[key]
+	if ok {
+		delete(inheritListeners, key)
+	}
+	return f, ok
+}
+
+// takeInheritListener 返回从旧进程继承的 socket, 每个 socket 只能被取一次
+func takeInheritListener(key string) (net.Listener, bool, error) {
+	f, ok := takeInheritFile(key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, true, errors.Wrap(err, "inherit listener '"+key+"' fail")
+	}
+	return ln, true, nil
+}
+
+// listenInherit 在重启时返回从旧进程继承的 socket, 没有时调用 listen 监听新的 socket
+func listenInherit(key string, listen func() (string, net.Listener, error)) (string, net.Listener, error) {
+	ln, ok, err := takeInheritListener(key)
+	if !ok {
+		return listen()
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return ln.Addr().String(), ln, nil
+}
+
+// takeInheritPacketConn 和 takeInheritListener 一样, 但用于 udp 的 socket
+func takeInheritPacketConn(key string) (net.PacketConn, bool, error) {
+	f, ok := takeInheritFile(key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, true, errors.Wrap(err, "inherit packet conn '"+key+"' fail")
+	}
+	return conn, true, nil
+}
+
+// notifyInheritReady 通知旧进程本进程已经就绪
+func notifyInheritReady() {
+	inheritReadyOnce.Do(func() {
+		value := os.Getenv(EnvInheritReadyFD)
+		if value == "" {
+			return
+		}
+		os.Unsetenv(EnvInheritReadyFD)
+
+		fd, err := strconv.Atoi(value)
+		if err != nil {
+			return
+		}
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	})
+}
+
+// restartCommand 返回 Restart 启动新进程的命令, 默认用相同的参数运行当前的程序
+var restartCommand = func() (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// Restart 启动一个新的进程并将监听的 socket 交给它, 新进程就绪后旧进程
+// 停止接收新连接并等待已有的请求处理完成 (见 Stop)
+func (r *Runner) Restart(ctx context.Context) error {
+	if runtime.GOOS == "windows" {
+		return ErrRestartUnsupported
+	}
+
+	keys, files, err := func() ([]string, []*os.File, error) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		if len(r.servers) == 0 {
+			return nil, nil, ErrServerInitializing
+		}
+
+		var keys []string
+		var files []*os.File
+		for _, es := range r.servers {
+			for key, socket := range es.inheritables() {
+				filer, ok := socket.(interface{ File() (*os.File, error) })
+				if !ok {
+					closeFiles(files)
+					return nil, nil, errors.New("socket '" + key + "' cannot be inherited")
+				}
+				f, err := filer.File()
+				if err != nil {
+					closeFiles(files)
+					return nil, nil, err
+				}
+				keys = append(keys, key)
+				files = append(files, f)
+			}
+		}
+		return keys, files, nil
+	}()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	cmd, err := restartCommand()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+
+	// ExtraFiles 中的第 i 个文件在新进程中的 fd 是 3+i
+	inherits := make([]string, len(keys))
+	for idx := range keys {
+		inherits[idx] = keys[idx] + "=" + strconv.Itoa(3+idx)
+	}
+
+	cmd.ExtraFiles = append(files[:len(files):len(files)], readyWriter)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	// WATCHDOG_PID 是当前进程的 pid, 新进程继承它的话 SdWatchdogInterval 返回 0,
+	// 新进程不会发送 WATCHDOG=1 而被 systemd 杀掉
+	cmd.Env = append(removeEnv(cmd.Env, "WATCHDOG_PID"),
+		EnvInheritListeners+"="+strings.Join(inherits, ","),
+		EnvInheritReadyFD+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	setNonblock(files)
+	if err != nil {
+		return errors.Wrap(err, "start new process fail")
+	}
+	r.Logger.Info("new process is started", log.Int("pid", cmd.Process.Pid))
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		var buf [1]byte
+		_, err := io.ReadFull(readyReader, buf[:])
+		ready <- err
+	}()
+
+	timer := time.NewTimer(DefaultRestartTimeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = errors.New("new process exited before it is ready")
+		}
+	case <-timer.C:
+		err = errors.New("wait for new process ready timeout")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		select {
+		case <-exited:
+		default:
+			cmd.Process.Kill()
+		}
+		r.Logger.Warn("restart fail, continue to serve", log.Error(err))
+		return err
+	}
+
+	r.Logger.Info("new process is ready, stop serving", log.Int("pid", cmd.Process.Pid))
+
+	// socket 文件已经交给了新进程, 关闭时不能删除它
+	r.lock.Lock()
+	for _, es := range r.servers {
+		if ul, ok := es.listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	r.lock.Unlock()
+	return r.stop(ctx, true)
+}
+
+// RestartOnSignal 收到信号 (默认为 SIGHUP) 时调用 Restart, 直到 ctx 结束或者 Restart 成功
+func (r *Runner) RestartOnSignal(ctx context.Context, sig ...os.Signal) {
+	if len(sig) == 0 {
+		sig = []os.Signal{syscall.SIGHUP}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+
+	go func() {
+		defer signal.Stop(c)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-c:
+				r.Logger.Info("received signal, restart", log.Stringer("signal", s))
+				if err := r.Restart(ctx); err == nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func removeEnv(env []string, name string) []string {
+	results := make([]string, 0, len(env))
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, name+"=") {
+			results = append(results, kv)
+		}
+	}
+	return results
+}
@@ -0,0 +1,350 @@
+//go:build !windows
+// +build !windows
+
+package loong
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func resetInheritState(t *testing.T) {
+	reset := func() {
+		inheritOnce = sync.Once{}
+		inheritListeners = nil
+		inheritReadyOnce = sync.Once{}
+	}
+	reset()
+	t.Cleanup(func() {
+		for _, f := range inheritListeners {
+			f.Close()
+		}
+		reset()
+	})
+}
+
+// dupFile 返回 f 的一个新的 fd, 它由被测试的函数负责关闭
+func dupFile(t *testing.T, f *os.File) int {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestTakeInheritListener(t *testing.T) {
+	resetInheritState(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnFile.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pcFile, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pcFile.Close()
+
+	// 不是 socket 的 fd
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	t.Setenv(EnvInheritListeners, strings.Join([]string{
+		inheritKey("", "") + "=" + strconv.Itoa(dupFile(t, lnFile)),
+		inheritKey("", "/h3") + "=" + strconv.Itoa(dupFile(t, pcFile)),
+		inheritKey("pipe", "") + "=" + strconv.Itoa(dupFile(t, pr)),
+		"invalid",
+		inheritKey("abc", "") + "=abc",
+	}, ","))
+
+	inherited, ok, err := takeInheritListener(inheritKey("", ""))
+	if !ok || err != nil {
+		t.Fatal("want ok got", ok, err)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != ln.Addr().String() {
+		t.Error("want", ln.Addr(), "got", inherited.Addr())
+	}
+	if os.Getenv(EnvInheritListeners) != "" {
+		t.Error("env should be unset")
+	}
+
+	// 每个 socket 只能被取一次
+	if _, ok, _ := takeInheritListener(inheritKey("", "")); ok {
+		t.Error("want not ok")
+	}
+
+	conn, ok, err := takeInheritPacketConn(inheritKey("", "/h3"))
+	if !ok || err != nil {
+		t.Fatal("want ok got", ok, err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().String() != pc.LocalAddr().String() {
+		t.Error("want", pc.LocalAddr(), "got", conn.LocalAddr())
+	}
+	if _, ok, _ := takeInheritPacketConn(inheritKey("", "/h3")); ok {
+		t.Error("want not ok")
+	}
+
+	if _, ok, err := takeInheritListener(inheritKey("pipe", "")); !ok || err == nil {
+		t.Error("want error got", ok, err)
+	}
+	if _, ok, _ := takeInheritListener(inheritKey("abc", "")); ok {
+		t.Error("want not ok")
+	}
+}
+
+func TestNotifyInheritReady(t *testing.T) {
+	resetInheritState(t)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	t.Setenv(EnvInheritReadyFD, strconv.Itoa(dupFile(t, pw)))
+	pw.Close()
+
+	notifyInheritReady()
+	notifyInheritReady()
+
+	bs, err := io.ReadAll(pr)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(bs) != 1 {
+		t.Error("want 1 byte got", bs)
+	}
+	if os.Getenv(EnvInheritReadyFD) != "" {
+		t.Error("env should be unset")
+	}
+}
+
+const envRestartHelper = "LOONG_TEST_RESTART_HELPER"
+
+// envRestartEndpoints 不为空时父进程和新进程都使用 newRestartRunner 中的多个端点
+const envRestartEndpoints = "LOONG_TEST_RESTART_ENDPOINTS"
+
+// newRestartRunner 返回父进程和新进程使用的 Runner, 设置了 envRestartEndpoints 时
+// 还有一个和主端点使用相同地址的 admin 端点
+func newRestartRunner(t *testing.T) *Runner {
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "http",
+		ListenAt: "127.0.0.1:0",
+	}
+	if os.Getenv(envRestartEndpoints) != "" {
+		r.Endpoints = []Endpoint{
+			{Name: "admin", Network: "http", ListenAt: "127.0.0.1:0"},
+		}
+	}
+	return r
+}
+
+// TestRestartHelperProcess 是 TestRunnerRestart 启动的新进程, 它继承 socket 后处理
+// 一个请求然后退出
+func TestRestartHelperProcess(t *testing.T) {
+	if os.Getenv(envRestartHelper) != "1" {
+		t.Skip("helper process")
+	}
+
+	served := make(chan struct{}, 2)
+	r := newRestartRunner(t)
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "child watchdog="+SdWatchdogInterval().String())
+		served <- struct{}{}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个端点处理一个请求
+	for range r.servers {
+		select {
+		case <-served:
+		case <-time.After(10 * time.Second):
+		}
+	}
+	r.Stop(ctx)
+	os.Exit(0)
+}
+
+func replaceRestartCommand(t *testing.T, name string, args ...string) {
+	old := restartCommand
+	restartCommand = func() (*exec.Cmd, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Env = append(os.Environ(), envRestartHelper+"=1")
+		cmd.Stderr = os.Stderr
+		return cmd, nil
+	}
+	t.Cleanup(func() {
+		restartCommand = old
+	})
+}
+
+func startRestartRunner(t *testing.T) (*Runner, func() (string, error)) {
+	r, get := startRestartEndpoints(t)
+	return r, func() (string, error) {
+		return get("")
+	}
+}
+
+// startRestartEndpoints 和 startRestartRunner 一样, 但返回的 get 可以指定端点
+func startRestartEndpoints(t *testing.T) (*Runner, func(name string) (string, error)) {
+	r := newRestartRunner(t)
+	err := r.Start(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "parent")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后旧进程已经停止了, 所以要先取得 URL
+	urls := map[string]string{}
+	for _, es := range r.servers {
+		urls[es.Name], _ = r.EndpointURL(es.Name)
+	}
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	return r, func(name string) (string, error) {
+		response, err := client.Get(urls[name])
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		bs, err := io.ReadAll(response.Body)
+		return string(bs), err
+	}
+}
+
+func TestRunnerRestart(t *testing.T) {
+	replaceRestartCommand(t, os.Args[0], "-test.run=^TestRestartHelperProcess$")
+
+	// 新进程不能继承 WATCHDOG_PID, 否则它的 watchdog 被禁用
+	t.Setenv("WATCHDOG_USEC", "1000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	ctx := context.Background()
+	r, get := startRestartRunner(t)
+	defer r.Stop(ctx)
+
+	if body, err := get(); err != nil || body != "parent" {
+		t.Error("want parent got", body, err)
+	}
+
+	if err := r.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r.IsReady() {
+		t.Error("old runner should be stopped")
+	}
+
+	// 同一个地址现在由新进程处理
+	if body, err := get(); err != nil || body != "child watchdog=1s" {
+		t.Error("want child got", body, err)
+	}
+}
+
+// 多个端点配置了相同的地址时, 每个端点都要取回自己的 socket
+func TestRunnerRestartEndpoints(t *testing.T) {
+	resetInheritState(t)
+	replaceRestartCommand(t, os.Args[0], "-test.run=^TestRestartHelperProcess$")
+	t.Setenv(envRestartEndpoints, "1")
+
+	ctx := context.Background()
+	r, get := startRestartEndpoints(t)
+	defer r.Stop(ctx)
+
+	mainAddr, _ := r.ListenAddr()
+	adminAddr, _ := r.ListenAddr("admin")
+	if mainAddr.String() == adminAddr.String() {
+		t.Fatal("want different address got", adminAddr)
+	}
+
+	if err := r.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "admin"} {
+		if body, err := get(name); err != nil || !strings.HasPrefix(body, "child") {
+			t.Errorf("endpoint %q want child got %q %v", name, body, err)
+		}
+	}
+}
+
+func TestRunnerRestartFail(t *testing.T) {
+	old := DefaultRestartTimeout
+	DefaultRestartTimeout = 200 * time.Millisecond
+	defer func() {
+		DefaultRestartTimeout = old
+	}()
+
+	ctx := context.Background()
+	if err := (&Runner{Logger: logtest.NewLogger(t)}).Restart(ctx); err != ErrServerInitializing {
+		t.Error("want ErrServerInitializing got", err)
+	}
+
+	for _, test := range []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"sleep", "10"}, err: "timeout"},
+		{args: []string{"true"}, err: "exited before it is ready"},
+	} {
+		replaceRestartCommand(t, test.args[0], test.args[1:]...)
+
+		r, get := startRestartRunner(t)
+		err := r.Restart(ctx)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Error(test.args, "want", test.err, "got", err)
+		}
+
+		// 新进程没有就绪时继续提供服务
+		if body, err := get(); err != nil || body != "parent" {
+			t.Error(test.args, "want parent got", body, err)
+		}
+		r.Stop(ctx)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	r := &Runner{Logger: logtest.NewLogger(t)}
+	r.servers = []*endpointServer{{
+		inheritKey: inheritKey("", ""),
+		listener:   struct{ net.Listener }{ln},
+	}}
+	if err := r.Restart(ctx); err == nil || !strings.Contains(err.Error(), "cannot be inherited") {
+		t.Error("want cannot be inherited got", err)
+	}
+}
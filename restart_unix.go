@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package loong
+
+import (
+	"os"
+	"syscall"
+)
+
+// setNonblock 恢复 socket 的非阻塞模式。exec.Cmd 对 ExtraFiles 调用了 Fd(), 它将
+// fd 设为阻塞模式, 而 File() 返回的 fd 和 listener 共用同一个文件描述, 如果不恢复,
+// 新进程启动失败后 listener 的 Accept 会阻塞, Close 也无法让它返回
+func setNonblock(files []*os.File) {
+	for _, f := range files {
+		if rc, err := f.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) {
+				syscall.SetNonblock(int(fd), true)
+			})
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package loong
+
+import "os"
+
+// windows 中不支持 Restart
+func setNonblock(files []*os.File) {}
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mei-rune/ipfilter"
 	"github.com/runner-mei/errors"
@@ -16,6 +18,38 @@ var ErrServerInitializing = errors.New("service initializing")
 var ErrServerAlreadyStart = errors.New("service already start")
 var ErrServerAlreadyStop = errors.New("service already stop")
 
+// ErrShutdownTimeout 是 Stop 时在 ShutdownTimeout 内没有处理完请求, 强制关闭连接后返回的错误
+var ErrShutdownTimeout = errors.New("shutdown timeout, connections are closed forcibly")
+
+// joinedError 是多个错误合并后的结果, 它实现了 Unwrap() []error, 所以
+// errors.Is(err, ErrShutdownTimeout) 可以检查其中的每一个错误
+type joinedError struct {
+	err  error
+	errs []error
+}
+
+func (e *joinedError) Error() string   { return e.err.Error() }
+func (e *joinedError) Unwrap() []error { return e.errs }
+
+// joinErrors 合并 errs 中不为 nil 的错误, 它和 errors.Join 不同的是结果支持 errors.Is
+func joinErrors(errs ...error) error {
+	var list []error
+	var err error
+	for _, e := range errs {
+		if e != nil {
+			list = append(list, e)
+			err = errors.Join(err, e)
+		}
+	}
+	if len(list) <= 1 {
+		return err
+	}
+	return &joinedError{err: err, errs: list}
+}
+
+// DefaultShutdownTimeout 是 Runner.ShutdownTimeout 为 0 时等待请求处理完成的时间
+var DefaultShutdownTimeout = 30 * time.Second
+
 type Hook interface {
 	OnStart(context.Context, *Runner) error
 	OnStop(context.Context, *Runner) error
@@ -56,23 +90,89 @@ type Runner struct {
 	KeyFile  string
 	CertFile string
 
-	TLCP struct {
-		SigCertFile string
-		SigKeyFile  string
-		EncCertFile string
-		EncKeyFile  string
-	}
+	// OCSPStapleFile 为可选的 DER 格式的 OCSP 响应, 它会和证书一起发送给客户端
+	OCSPStapleFile string
+
+	// TLS 仅在 Network 为 https/tls/ssl 时有效, 在 Start 时校验
+	TLS TLSConfig
+
+	// ClientAuth 是客户端证书认证的参数, 对 https 和 tlcp 都有效, 见 ClientCertAuth
+	ClientAuth ClientAuthConfig
+
+	// SNI 按主机名选择证书, 对 https 和 tlcp 都有效, 此时 CertFile/KeyFile
+	// (或 TLCP 中的证书) 是没有匹配时的默认证书, 可以为空
+	SNI SNIConfig
+
+	// SelfSigned 的 Dir 不为空时, 如果证书文件不存在则自动生成本地 CA 和自签名的证书,
+	// 仅用于开发环境和首次安装, 见 SelfSignedConfig
+	SelfSigned SelfSignedConfig
+
+	// HTTP2 是 http2 和 h2c 的参数, 见 HTTP2Config
+	HTTP2 HTTP2Config
+
+	// HTTP3 仅在 Network 为 h3/quic 时有效, 此时除了 tcp 上的 https 之外, 还在
+	// 相同端口的 udp 上提供 http3, 并通过 Alt-Svc 头通知客户端, 见 HTTP3Config。
+	// 需要导入 github.com/runner-mei/loong/h3
+	HTTP3 HTTP3Config
+
+	// Limits 是 http.Server 的超时、tcp keepalive 和最大连接数, 为 0 的字段使用
+	// 安全的默认值 (如 ReadHeaderTimeout 为 10 秒), 见 LimitsConfig
+	Limits LimitsConfig
+
+	// ProxyProtocol 的 TrustedCIDRs 不为空时, 解析来自这些地址 (如 HAProxy 或者 L4
+	// 负载均衡) 的连接上的 PROXY 协议头, RedirectHTTP 的端口也一样, 见 ProxyProtocolConfig
+	ProxyProtocol ProxyProtocolConfig
+
+	// PlainHTTP 仅在 Network 为 auto 时有效, 决定同一个端口上收到明文 http 请求时
+	// 的处理方式: reject (默认, 直接关闭连接)、accept 或 redirect (308 重定向到 https)
+	PlainHTTP string
+
+	TLCP TLCPConfig
+
+	// UnixSocket 仅在 Network 为 unix 时有效, ListenAt 为 socket 文件的路径,
+	// 在 Linux 中以 @ 开头时为抽象 socket
+	UnixSocket UnixSocketConfig
 
 	CandidatePortStart int
 	CandidatePortEnd   int
 
-	lock     sync.Mutex
-	srv      *http.Server
-	listener net.Listener
+	// RedirectHTTP 和 HSTS 仅在 Network 为 https/tls/tlcp 时有效
+	RedirectHTTP RedirectHTTPConfig
+	HSTS         HSTSConfig
+
+	// CertReloadInterval 大于 0 时按这个间隔检查证书文件, 有变化时重新加载,
+	// 也可以调用 ReloadCertificates 或 ReloadCertificatesOnSignal
+	CertReloadInterval time.Duration
+
+	// Endpoints 是除上面的主端点之外的其它端点, 它们使用同一个 handler,
+	// 名称不能为空也不能重复。当 Network 和 ListenAt 都为空时只监听 Endpoints
+	Endpoints []Endpoint
+
+	// ShutdownTimeout 是 Stop 时等待正在处理的请求 (包括被 Hijack 的连接,
+	// 如 WebSocket) 完成的最长时间, 超时后强制关闭连接, 为 0 时使用 DefaultShutdownTimeout
+	ShutdownTimeout time.Duration
+
+	// PreStopDelay 是 Stop 开始后 (此时 readiness 已经为 false) 继续接收请求的
+	// 时间, 以便负载均衡有时间摘除本实例
+	PreStopDelay time.Duration
+
+	lock       sync.Mutex
+	servers    []*endpointServer
+	ready      atomic.Bool
+	onShutdown []func()
+
+	sdWatchdogCancel context.CancelFunc
+	certWatchCancel  context.CancelFunc
 
 	hooks []Hook
 }
 
+// IsReady 在所有的 OnStart 成功后返回 true, 在 Stop 开始时立即变为 false
+func (r *Runner) IsReady() bool {
+	return r.ready.Load()
+}
+
+// Append 添加一个 Hook, OnStart 按添加的顺序执行, OnStop 按相反的顺序执行
 func (r *Runner) Append(hook Hook) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -80,6 +180,80 @@ func (r *Runner) Append(hook Hook) {
 	r.hooks = append(r.hooks, hook)
 }
 
+// RegisterOnShutdown 注册一个在 Stop 开始关闭服务时调用的函数, 被 Hijack 的
+// 连接 (如 WebSocket) 可以用它来通知客户端关闭连接, 它必须在 Start 之前调用
+func (r *Runner) RegisterOnShutdown(f func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onShutdown = append(r.onShutdown, f)
+}
+
+func (r *Runner) endpoints() ([]Endpoint, error) {
+	var endpoints []Endpoint
+	if r.Network != "" || r.ListenAt != "" || len(r.Endpoints) == 0 {
+		endpoints = append(endpoints, Endpoint{
+			IPFilterOptions:    r.IPFilterOptions,
+			Network:            r.Network,
+			ListenAt:           r.ListenAt,
+			KeyFile:            r.KeyFile,
+			CertFile:           r.CertFile,
+			OCSPStapleFile:     r.OCSPStapleFile,
+			TLS:                r.TLS,
+			ClientAuth:         r.ClientAuth,
+			SNI:                r.SNI,
+			SelfSigned:         r.SelfSigned,
+			HTTP2:              r.HTTP2,
+			HTTP3:              r.HTTP3,
+			Limits:             r.Limits,
+			ProxyProtocol:      r.ProxyProtocol,
+			PlainHTTP:          r.PlainHTTP,
+			TLCP:               r.TLCP,
+			UnixSocket:         r.UnixSocket,
+			RedirectHTTP:       r.RedirectHTTP,
+			HSTS:               r.HSTS,
+			CandidatePortStart: r.CandidatePortStart,
+			CandidatePortEnd:   r.CandidatePortEnd,
+		})
+	}
+
+	names := map[string]struct{}{}
+	for _, ep := range r.Endpoints {
+		if ep.Name == "" {
+			return nil, errors.New("endpoint name is missing")
+		}
+		// 名称是 Restart 时交给新进程的 socket 的名称的一部分, 见 inheritKey
+		if strings.Contains(ep.Name, ",") {
+			return nil, errors.New("endpoint '" + ep.Name + "' has invalid characters")
+		}
+		if _, ok := names[ep.Name]; ok {
+			return nil, errors.New("endpoint '" + ep.Name + "' is duplicated")
+		}
+		names[ep.Name] = struct{}{}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// lookup 查找指定名称的端点, 名称为空时返回主端点 (没有主端点时返回第一个端点)
+func (r *Runner) lookup(name ...string) (*endpointServer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.servers) == 0 {
+		return nil, ErrServerInitializing
+	}
+	if len(name) == 0 || name[0] == "" {
+		return r.servers[0], nil
+	}
+	for _, es := range r.servers {
+		if es.Name == name[0] {
+			return es, nil
+		}
+	}
+	return nil, errors.New("endpoint '" + name[0] + "' isnot found")
+}
+
 func (r *Runner) MustURL(address ...string) string {
 	u, err := r.URL()
 	if err != nil {
@@ -89,7 +263,26 @@ func (r *Runner) MustURL(address ...string) string {
 }
 
 func (r *Runner) URL(address ...string) (string, error) {
-	port, err := r.ListenPort()
+	return r.EndpointURL("", address...)
+}
+
+// EndpointURL 返回指定名称的端点的 URL, 名称为空时为主端点
+func (r *Runner) EndpointURL(name string, address ...string) (string, error) {
+	es, err := r.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	scheme, err := es.scheme()
+	if err != nil {
+		return "", err
+	}
+
+	addr := es.listener.Addr()
+	if _, ok := addr.(*net.UnixAddr); ok {
+		// net/http 不支持 unix socket 的 URL, 用 NewUnixSocketTransport 访问它
+		return "", errors.New("endpoint '" + es.Name + "' is a unix socket and has no url, see NewUnixSocketTransport")
+	}
+	_, port, err := net.SplitHostPort(addr.String())
 	if err != nil {
 		return "", err
 	}
@@ -100,43 +293,35 @@ func (r *Runner) URL(address ...string) (string, error) {
 			hostAddress = address[0]
 		}
 	}
-
-	network := r.Network
-	switch strings.ToLower(network) {
-	case "http", "tcp":
-		network = "http"
-	case "https", "tls", "ssl", "tlcp":
-		network = "https"
-	default:
-		return "", errors.New("network '" + network + "' is unsupported")
-	}
-	return network + "://" + net.JoinHostPort(hostAddress, port), nil
+	return scheme + "://" + net.JoinHostPort(hostAddress, port), nil
 }
 
-func (r *Runner) ListenAddr() (net.Addr, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-
-	if r.srv == nil {
-		return nil, ErrServerInitializing
+// ListenAddr 返回指定名称的端点的监听地址, 名称为空时为主端点
+func (r *Runner) ListenAddr(name ...string) (net.Addr, error) {
+	es, err := r.lookup(name...)
+	if err != nil {
+		return nil, err
 	}
-	return r.listener.Addr(), nil
+	return es.listener.Addr(), nil
 }
 
 func isZeroAddress(addr string) bool {
 	return addr == "" || addr == "[::]" || addr == ":" || addr == ":0" || addr == "0.0.0.0:0"
 }
 
-func (r *Runner) ListenPort() (string, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-
-	if r.srv == nil {
-		return "", ErrServerInitializing
+// ListenPort 返回指定名称的端点的监听端口, 名称为空时为主端点
+func (r *Runner) ListenPort(name ...string) (string, error) {
+	es, err := r.lookup(name...)
+	if err != nil {
+		return "", err
+	}
+	addr := es.listener.Addr()
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return "", errors.New("unix socket '" + addr.String() + "' has no port")
 	}
 
 	// if isZeroAddress(r.ListenAt) {
-	_, port, err := net.SplitHostPort(r.listener.Addr().String())
+	_, port, err := net.SplitHostPort(addr.String())
 	return port, err
 	// }
 	// _, port, err := net.SplitHostPort(r.ListenAt)
@@ -153,11 +338,18 @@ func (r *Runner) Run(ctx context.Context, handler http.Handler) error {
 	select {
 	case <-stopped:
 	case <-ctx.Done():
+		// ctx 已经被取消了, 不能再用它来等待请求处理完成
+		ctx = context.Background()
 	}
 
 	return r.Stop(ctx)
 }
 
+// Start 监听所有的端点并执行 OnStart, 不等待服务结束。
+//
+// handler 为 *Engine 时会自动调用 Engine.Health.AddRunner("runner", r), 这样 Stop
+// 开始后 /internal/readyz 立即返回 503, 负载均衡在 PreStopDelay 内摘除本实例;
+// 其它的 handler 需要自己调用 Health.AddRunner
 func (r *Runner) Start(ctx context.Context, handler http.Handler) error {
 	return r.start(ctx, handler, nil)
 }
@@ -166,55 +358,50 @@ func (r *Runner) start(ctx context.Context, handler http.Handler, stopped chan s
 	if handler == nil {
 		return errors.New("handler is missing")
 	}
-	network := r.Network
-	isHTTPs := false
-	isTLCP := false
-
-	switch strings.ToLower(network) {
-	case "http", "tcp":
-		network = "tcp"
-	case "https", "tls", "ssl":
-		isHTTPs = true
-		network = "tcp"
-		if r.CertFile == "" || r.KeyFile == "" {
-			return errors.New("keyFile or certFile is missing")
-		}
-	case "tlcp":
-		isTLCP = true
-		isHTTPs = true
-		network = "tcp"
-		if r.TLCP.SigCertFile == "" || r.TLCP.SigKeyFile == "" {
-			return errors.New("sig keyFile or certFile is missing")
+	if e, ok := handler.(*Engine); ok && e.Health != nil {
+		e.Health.AddRunner("runner", r)
+	}
+
+	endpoints, err := r.endpoints()
+	if err != nil {
+		return err
+	}
+	servers := make([]*endpointServer, 0, len(endpoints))
+	for _, ep := range endpoints {
+		es, err := newEndpointServer(ep)
+		if err != nil {
+			if ep.Name != "" {
+				err = errors.Wrap(err, "endpoint '"+ep.Name+"'")
+			}
+			return err
 		}
-		if r.TLCP.EncCertFile == "" || r.TLCP.EncKeyFile == "" {
-			return errors.New("enc keyFile or certFile is missing")
+		servers = append(servers, es)
+	}
+
+	closeListeners := func() {
+		for _, es := range servers {
+			es.close()
 		}
-	default:
-		return errors.New("listen: network '" + network + "' is unsupported")
 	}
 
-	var srv *http.Server
-	var listener net.Listener
 	var hooks []Hook
 
-	err := func() error {
+	err = func() error {
 		r.lock.Lock()
 		defer r.lock.Unlock()
 
-		if r.srv != nil {
+		if len(r.servers) != 0 {
 			return ErrServerAlreadyStart
 		}
 
-		listenAt, ln, err := ListenAtDynamicPort(network, r.ListenAt, r.CandidatePortStart, r.CandidatePortEnd)
-		if err != nil {
-			return err
+		for _, es := range servers {
+			err := es.listen(handler, r.onShutdown)
+			if err != nil {
+				closeListeners()
+				return err
+			}
 		}
-
-		listener = ln
-		srv = &http.Server{Addr: listenAt, Handler: handler}
-
-		r.listener = listener
-		r.srv = srv
+		r.servers = servers
 
 		hooks = make([]Hook, len(r.hooks))
 		copy(hooks, r.hooks)
@@ -227,103 +414,101 @@ func (r *Runner) start(ctx context.Context, handler http.Handler, stopped chan s
 	for idx := range hooks {
 		err = hooks[idx].OnStart(ctx, r)
 		if err != nil {
-			listener.Close()
+			closeListeners()
 
-			for i := 0; i < idx; i++ {
+			for i := idx - 1; i >= 0; i-- {
 				hooks[i].OnStop(ctx, r)
 			}
+
+			r.lock.Lock()
+			r.servers = nil
+			r.lock.Unlock()
 			return err
 		}
 	}
-
-	go func() {
-		if stopped != nil {
-			defer close(stopped)
-		}
-
-		r.Logger.Info("http listen at: " + r.Network + "+" + listener.Addr().String())
-
-		tcpListener, ok := listener.(*net.TCPListener)
-		if ok {
-			listener = TcpKeepAliveListener{tcpListener}
-		}
-
-		if !r.IPFilterOptions.TrustProxy {
-			listener = ipfilter.WrapListener(listener, r.IPFilterOptions, func(addr net.Addr) {
-				if r.IPFilterOptions.Logger != nil {
-					r.IPFilterOptions.Logger.Printf("ip is blocked: addr = %s", addr)
-				} else {
-					r.Logger.Info("ip is blocked", log.Stringer("addr", addr))
-				}
-			})
-		}
-
-		var err error
-		if isTLCP {
-			listener, err = r.enableTlcp(listener)
-			if err != nil {
-				r.Logger.Error("enable tlcp unsuccessful", log.Error(err))
-				err = errors.Wrap(err, "enable tlcp unsuccessful")
-			} else {
-				err = srv.Serve(listener)
+	r.ready.Store(true)
+	notifyInheritReady()
+	r.sdNotifyReady()
+	r.startWatchCertificates()
+
+	// 任何一个端点停止服务时都通知 Run 停止所有的端点
+	var stoppedOnce sync.Once
+	for _, es := range servers {
+		go func(es *endpointServer) {
+			if stopped != nil {
+				defer stoppedOnce.Do(func() { close(stopped) })
 			}
-		} else if isHTTPs {
-			err = srv.ServeTLS(listener, r.CertFile, r.KeyFile)
-		} else {
-			err = srv.Serve(listener)
-		}
-		if err != nil {
-			if err != http.ErrServerClosed {
-				r.Logger.Error("http server start unsuccessful", log.Error(err))
-			} else {
-				r.Logger.Info("http server stopped")
-			}
-		}
-	}()
+			es.serve(r.Logger)
+		}(es)
+	}
 	return nil
 }
 
+// Stop 停止服务并等待请求处理完成, 超过 ShutdownTimeout 时强制关闭连接。
+//
+// 返回的错误可能是多个端点和 OnStop 的错误合并后的结果, 需要用
+// errors.Is(err, ErrShutdownTimeout) 判断是否强制关闭了连接, 不能直接比较
 func (r *Runner) Stop(ctx context.Context) error {
-	hooks, err := func() ([]Hook, error) {
-		r.lock.Lock()
-		defer r.lock.Unlock()
-
-		if r.srv == nil {
-			return nil, nil
-		}
-
-		listenAt := r.listener.Addr().String()
+	return r.stop(ctx, false)
+}
 
-		err1 := r.srv.Close()
-		err2 := r.listener.Close()
-		if err2 != nil {
-			if strings.Contains(err2.Error(), "use of closed network connection") {
-				err2 = nil
-			}
-		}
+// stop 停止服务, handoff 表示 socket 已经交给了 Restart 启动的新进程
+func (r *Runner) stop(ctx context.Context, handoff bool) error {
+	r.ready.Store(false)
 
-		r.srv = nil
-		r.listener = nil
-		if err := errors.Join(err1, err2); err != nil {
-			r.Logger.Info("http '" + r.Network + "+" + listenAt + "' is stop failure")
-			return nil, err
-		}
+	servers, hooks := func() ([]*endpointServer, []Hook) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
 
-		r.Logger.Info("http '" + r.Network + "+" + listenAt + "' is stopped")
+		servers := r.servers
+		r.servers = nil
 
 		hooks := make([]Hook, len(r.hooks))
 		copy(hooks, r.hooks)
-		return hooks, nil
+		return servers, hooks
 	}()
-	if err != nil {
-		return err
+	if len(servers) == 0 {
+		return nil
 	}
-
-	for idx := range hooks {
-		err = hooks[idx].OnStop(ctx, r)
-		if err != nil {
-			return err
+	r.sdNotifyStopping(handoff)
+	r.stopWatchCertificates()
+
+	if r.PreStopDelay > 0 {
+		r.Logger.Info("http server is waiting for deregistration", log.Duration("delay", r.PreStopDelay))
+		timer := time.NewTimer(r.PreStopDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
 		}
 	}
-	return nil
+
+	timeout := r.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	errList := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for idx := range servers {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			es := servers[idx]
+			listenAt := es.listener.Addr().String()
+			errList[idx] = es.shutdown(ctx, timeout, r.Logger)
+			if errList[idx] != nil {
+				r.Logger.Info("http '" + es.Network + "+" + listenAt + "' is stop failure")
+			} else {
+				r.Logger.Info("http '" + es.Network + "+" + listenAt + "' is stopped")
+			}
+		}(idx)
+	}
+	wg.Wait()
+
+	for idx := len(hooks) - 1; idx >= 0; idx-- {
+		errList = append(errList, hooks[idx].OnStop(ctx, r))
+	}
+	return joinErrors(errList...)
 }
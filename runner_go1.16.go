@@ -1,30 +1,329 @@
 //go:build go1.16
 // +build go1.16
 
+// 这里用到了 atomic.Pointer, loong 需要 go1.19 以上的版本 (go.mod 中为 go 1.20),
+// 所以不再提供低版本中不支持 tlcp 的实现
+
 package loong
 
 import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"gitee.com/Trisia/gotlcp/tlcp"
+	"github.com/emmansun/gmsm/sm2"
+	"github.com/emmansun/gmsm/smx509"
 	"github.com/runner-mei/errors"
 )
 
-func (r *Runner) enableTlcp(listener net.Listener) (net.Listener, error) {
-	sigCertificate, err := tlcp.LoadX509KeyPair(r.TLCP.SigCertFile, r.TLCP.SigKeyFile)
+// tlcpCertificates 通过 GetCertificate 和 GetKECertificate 提供签名证书和
+// 加密证书, 调用 Reload 时重新加载证书和 CRL, 任何一个无效时都继续使用原来的。
+// 客户端的 CA 只在启动时加载。配置了 SNI 时按主机名选择证书, 没有匹配时使用
+// config 中的证书
+type tlcpCertificates struct {
+	config     TLCPConfig
+	clientAuth ClientAuthConfig
+	sniConfig  SNIConfig
+	clientCAs  *smx509.CertPool
+	sig        atomic.Pointer[tlcp.Certificate]
+	enc        atomic.Pointer[tlcp.Certificate]
+	sni        atomic.Pointer[map[string]tlcpKeyPairs]
+	revoked    atomic.Pointer[revocationList]
+
+	nextProtos []string
+	configOnce sync.Once
+	config0    *tlcp.Config
+}
+
+type tlcpKeyPairs struct {
+	sig *tlcp.Certificate
+	enc *tlcp.Certificate
+}
+
+func loadTlcpKeyPairs(config TLCPConfig) (tlcpKeyPairs, error) {
+	sigCertificate, err := tlcp.LoadX509KeyPair(config.SigCertFile, config.SigKeyFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "加载 sig 证书失败")
+		return tlcpKeyPairs{}, errors.Wrap(err, "加载 sig 证书失败")
+	}
+
+	encCertificate, err := tlcp.LoadX509KeyPair(config.EncCertFile, config.EncKeyFile)
+	if err != nil {
+		return tlcpKeyPairs{}, errors.Wrap(err, "加载 enc 证书失败")
+	}
+	return tlcpKeyPairs{sig: &sigCertificate, enc: &encCertificate}, nil
+}
+
+// nextProtos 是 ALPN 的协议列表
+func newTlcpCertificates(config TLCPConfig, clientAuth ClientAuthConfig, sni SNIConfig, nextProtos []string) (*tlcpCertificates, error) {
+	c := &tlcpCertificates{config: config, clientAuth: clientAuth, sniConfig: sni, nextProtos: nextProtos}
+	if clientAuth.CAFile != "" {
+		bs, err := os.ReadFile(clientAuth.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ca '"+clientAuth.CAFile+"' fail")
+		}
+		c.clientCAs = smx509.NewCertPool()
+		if !c.clientCAs.AppendCertsFromPEM(bs) {
+			return nil, errors.New("ca '" + clientAuth.CAFile + "' has no certificate")
+		}
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *tlcpCertificates) Files() []string {
+	var files []string
+	if c.config != (TLCPConfig{}) {
+		files = append(files,
+			c.config.SigCertFile, c.config.SigKeyFile,
+			c.config.EncCertFile, c.config.EncKeyFile)
+	}
+	if !c.sniConfig.IsEmpty() {
+		_, sniFiles, _ := c.sniConfig.entries(true)
+		files = append(files, sniFiles...)
+	}
+	return append(files, c.clientAuth.CRLFiles...)
+}
+
+func (c *tlcpCertificates) Reload() error {
+	var pairs tlcpKeyPairs
+	if c.config != (TLCPConfig{}) {
+		var err error
+		pairs, err = loadTlcpKeyPairs(c.config)
+		if err != nil {
+			return err
+		}
 	}
 
-	encCertificate, err := tlcp.LoadX509KeyPair(r.TLCP.EncCertFile, r.TLCP.EncKeyFile)
+	revoked, err := loadRevocationList(c.clientAuth.CRLFiles)
 	if err != nil {
-		return nil, errors.Wrap(err, "加载 enc 证书失败")
+		return err
+	}
+
+	// 某个主机的证书无效时继续使用它原来的证书
+	var sniErr error
+	sni := map[string]tlcpKeyPairs{}
+	if !c.sniConfig.IsEmpty() {
+		entries, _, err := c.sniConfig.entries(true)
+		if err != nil {
+			return err
+		}
+		var old map[string]tlcpKeyPairs
+		if p := c.sni.Load(); p != nil {
+			old = *p
+		}
+		for host, entry := range entries {
+			p, err := loadTlcpKeyPairs(entry.TLCP)
+			if err != nil {
+				sniErr = errors.Join(sniErr, errors.Wrap(err, "sni '"+host+"'"))
+				if o, ok := old[host]; ok {
+					sni[host] = o
+				}
+				continue
+			}
+			sni[host] = p
+		}
 	}
 
-	tlcpconfig := &tlcp.Config{Certificates: []tlcp.Certificate{
-		sigCertificate,
-		encCertificate,
-	}}
+	if pairs.sig != nil {
+		c.sig.Store(pairs.sig)
+		c.enc.Store(pairs.enc)
+	}
+	c.sni.Store(&sni)
+	c.revoked.Store(&revoked)
+	return sniErr
+}
+
+func (c *tlcpCertificates) lookup(serverName string) (tlcpKeyPairs, error) {
+	if pairs, ok := matchServerName(*c.sni.Load(), serverName); ok {
+		return pairs, nil
+	}
+	if sig := c.sig.Load(); sig != nil {
+		return tlcpKeyPairs{sig: sig, enc: c.enc.Load()}, nil
+	}
+	return tlcpKeyPairs{}, errors.New("no certificate for server name '" + serverName + "'")
+}
+
+// tlcpConfig 返回的 tlcp.Config 是共用的, 以便 auto 模式下所有的连接共用 session 缓存
+func (c *tlcpCertificates) tlcpConfig() *tlcp.Config {
+	c.configOnce.Do(func() {
+		c.config0 = c.newTlcpConfig()
+	})
+	return c.config0
+}
 
-	return tlcp.NewListener(listener, tlcpconfig), nil
+func (c *tlcpCertificates) newTlcpConfig() *tlcp.Config {
+	mode, _ := parseClientAuthMode(c.clientAuth.Mode)
+	return &tlcp.Config{
+		GetCertificate: func(hello *tlcp.ClientHelloInfo) (*tlcp.Certificate, error) {
+			pairs, err := c.lookup(hello.ServerName)
+			return pairs.sig, err
+		},
+		GetKECertificate: func(hello *tlcp.ClientHelloInfo) (*tlcp.Certificate, error) {
+			pairs, err := c.lookup(hello.ServerName)
+			return pairs.enc, err
+		},
+		// tlcp.ClientAuthType 的值和 tls.ClientAuthType 是一样的
+		NextProtos: c.nextProtos,
+		ClientAuth: tlcp.ClientAuthType(mode),
+		ClientCAs:  c.clientCAs,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*smx509.Certificate) error {
+			revoked := c.revoked.Load()
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if revoked.isRevoked(cert.RawIssuer, cert.SerialNumber) {
+						return errors.New("client certificate '" + cert.Subject.String() + "' is revoked")
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func enableTlcp(certs certificates, listener net.Listener) (net.Listener, error) {
+	c, ok := certs.(*tlcpCertificates)
+	if !ok {
+		return nil, errors.New("tlcp certificates is missing")
+	}
+	return tlcp.NewListener(listener, c.tlcpConfig()), nil
+}
+
+func tlcpServerConn(certs certificates, conn net.Conn) (net.Conn, error) {
+	c, ok := certs.(*tlcpCertificates)
+	if !ok {
+		return nil, errors.New("tlcp certificates is missing")
+	}
+	return tlcp.Server(conn, c.tlcpConfig()), nil
+}
+
+// tlcpHandshake 完成 tlcp 握手并返回 ALPN 协商的协议
+func tlcpHandshake(conn net.Conn) (string, error) {
+	c, ok := conn.(*tlcp.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := c.Handshake(); err != nil {
+		return "", err
+	}
+	return c.ConnectionState().NegotiatedProtocol, nil
+}
+
+type tlcpConnKey struct{}
+
+func tlcpConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*tlcp.Conn); ok {
+		return context.WithValue(ctx, tlcpConnKey{}, conn)
+	}
+	return ctx
+}
+
+func tlcpPeerIdentity(ctx context.Context) *CertificateIdentity {
+	conn, ok := ctx.Value(tlcpConnKey{}).(*tlcp.Conn)
+	if !ok {
+		return nil
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	return &CertificateIdentity{
+		Subject:        cert.Subject,
+		Issuer:         cert.Issuer,
+		SerialNumber:   cert.SerialNumber,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		NotBefore:      cert.NotBefore,
+		NotAfter:       cert.NotAfter,
+		SM2:            true,
+		Raw:            cert.Raw,
+	}
+}
+
+func sm2CertIssuer() *certIssuer {
+	return &certIssuer{
+		generateKey: func() (crypto.Signer, error) {
+			return sm2.GenerateKey(rand.Reader)
+		},
+		marshalKey: func(key crypto.Signer) ([]byte, error) {
+			return smx509.MarshalPKCS8PrivateKey(key)
+		},
+		parseKey: func(der []byte) (crypto.Signer, error) {
+			key, err := smx509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("private key isnot a signer")
+			}
+			return signer, nil
+		},
+		parseCert: func(der []byte) (*x509.Certificate, error) {
+			cert, err := smx509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			return cert.ToX509(), nil
+		},
+		createCert: func(template, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) ([]byte, error) {
+			return smx509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+		},
+	}
+}
+
+// ensureSelfSignedTLCP 在 tlcp 的证书文件不存在时用 SM2 生成签名证书和加密证书,
+// 为空的文件名使用 Dir 中的 sm2-sig.crt, sm2-sig.key, sm2-enc.crt 和 sm2-enc.key
+func ensureSelfSignedTLCP(config *SelfSignedConfig, tlcpConfig *TLCPConfig) error {
+	for _, f := range []struct {
+		value *string
+		name  string
+	}{
+		{&tlcpConfig.SigCertFile, "sm2-sig.crt"},
+		{&tlcpConfig.SigKeyFile, "sm2-sig.key"},
+		{&tlcpConfig.EncCertFile, "sm2-enc.crt"},
+		{&tlcpConfig.EncKeyFile, "sm2-enc.key"},
+	} {
+		if *f.value == "" {
+			*f.value = filepath.Join(config.Dir, f.name)
+		}
+	}
+
+	issuer := sm2CertIssuer()
+	var ca *x509.Certificate
+	var caKey crypto.Signer
+	for _, pair := range []struct {
+		certFile, keyFile string
+		keyUsage          x509.KeyUsage
+	}{
+		{tlcpConfig.SigCertFile, tlcpConfig.SigKeyFile, x509.KeyUsageDigitalSignature},
+		{tlcpConfig.EncCertFile, tlcpConfig.EncKeyFile, x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageKeyAgreement},
+	} {
+		if fileExists(pair.certFile) && fileExists(pair.keyFile) {
+			continue
+		}
+		if ca == nil {
+			var err error
+			ca, caKey, err = issuer.loadOrCreateCA(filepath.Join(config.Dir, SelfSignedSM2CAFile), filepath.Join(config.Dir, "sm2-ca.key"), "loong local sm2 ca")
+			if err != nil {
+				return err
+			}
+		}
+		if err := issuer.issue(ca, caKey, config, pair.keyUsage, pair.certFile, pair.keyFile); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,148 @@
+//go:build go1.16
+// +build go1.16
+
+package loong
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitee.com/Trisia/gotlcp/tlcp"
+	"github.com/emmansun/gmsm/smx509"
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestRunnerSelfSignedTLCP(t *testing.T) {
+	dir := t.TempDir()
+	r := &Runner{
+		Logger:     logtest.NewLogger(t),
+		Network:    "tlcp",
+		ListenAt:   "127.0.0.1:0",
+		SelfSigned: SelfSignedConfig{Dir: dir},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(ctx)
+
+	bs, err := os.ReadFile(filepath.Join(dir, SelfSignedSM2CAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := smx509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		t.Fatal("sm2 ca has no certificate")
+	}
+
+	// 签名证书和加密证书都由 sm2 CA 签发
+	for _, test := range []struct {
+		certFile string
+		keyUsage x509.KeyUsage
+	}{
+		{certFile: "sm2-sig.crt", keyUsage: x509.KeyUsageDigitalSignature},
+		{certFile: "sm2-enc.crt", keyUsage: x509.KeyUsageKeyEncipherment},
+	} {
+		bs, err := os.ReadFile(filepath.Join(dir, test.certFile))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		block, _ := pem.Decode(bs)
+		if block == nil {
+			t.Error(test.certFile, "has no certificate")
+			continue
+		}
+		cert, err := smx509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Error(test.certFile, err)
+			continue
+		}
+		if _, err := cert.Verify(smx509.VerifyOptions{DNSName: "localhost", Roots: pool}); err != nil {
+			t.Error(test.certFile, err)
+		}
+		if cert.KeyUsage&test.keyUsage == 0 {
+			t.Errorf("%s want key usage %d got %d", test.certFile, test.keyUsage, cert.KeyUsage)
+		}
+	}
+
+	addr, _ := r.ListenAddr()
+	conn, err := tlcp.Dial("tcp", addr.String(), &tlcp.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET / HTTP/1.0\r\nHost: localhost\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Error("want ok got", response.StatusCode, string(body))
+	}
+}
+
+func TestRunnerAutoSNIMixed(t *testing.T) {
+	dir := t.TempDir()
+	var sm2 TLCPConfig
+	if err := ensureSelfSignedTLCP(&SelfSignedConfig{Dir: dir}, &sm2); err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "a.example.com.crt")
+	keyFile := filepath.Join(dir, "a.example.com.key")
+	writeTestCertificate(t, certFile, keyFile, 10, time.Now().Add(time.Hour))
+
+	// a 只有 https 的证书, b 只有 tlcp 的证书
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "auto",
+		ListenAt: "127.0.0.1:0",
+		SNI: SNIConfig{Certificates: map[string]SNICertificate{
+			"a.example.com": {CertFile: certFile, KeyFile: keyFile},
+			"b.example.com": {TLCP: sm2},
+		}},
+	}
+	ctx := context.Background()
+	if err := r.Start(ctx, http.NotFoundHandler()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(ctx)
+
+	addr, _ := r.ListenAddr()
+	for name, ok := range map[string]bool{"a.example.com": true, "b.example.com": false} {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr.String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != ok {
+			t.Error(name, ": want", ok, "got", err)
+		}
+	}
+
+	r.lock.Lock()
+	sni := *r.servers[0].tlcpCerts.(*tlcpCertificates).sni.Load()
+	r.lock.Unlock()
+	if _, ok := sni["b.example.com"]; !ok || len(sni) != 1 {
+		t.Error("want b.example.com got", sni)
+	}
+}
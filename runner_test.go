@@ -2,10 +2,16 @@ package loong
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/runner-mei/log/logtest"
 )
@@ -62,3 +68,322 @@ func TestRunner(t *testing.T) {
 		t.Error("want ok got", string(bs))
 	}
 }
+
+func TestRunnerGracefulStop(t *testing.T) {
+	var order []string
+	r := &Runner{
+		Logger:          logtest.NewLogger(t),
+		Network:         "http",
+		ListenAt:        "127.0.0.1:0",
+		ShutdownTimeout: 2 * time.Second,
+	}
+	for _, name := range []string{"a", "b"} {
+		name := name
+		r.Append(MakeHook(nil, func(context.Context, *Runner) error {
+			order = append(order, name)
+			return nil
+		}))
+	}
+
+	started := make(chan struct{})
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	u, err := r.URL()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		response, err := http.Get(u)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		bs, _ := io.ReadAll(response.Body)
+		result <- string(bs)
+	}()
+
+	<-started
+	if err := r.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+
+	if s := <-result; s != "ok" {
+		t.Error("want ok got", s)
+	}
+	if len(order) != 2 || order[0] != "b" || order[1] != "a" {
+		t.Error("want [b a] got", order)
+	}
+}
+
+func TestRunnerStopHijacked(t *testing.T) {
+	r := &Runner{
+		Logger:          logtest.NewLogger(t),
+		Network:         "http",
+		ListenAt:        "127.0.0.1:0",
+		ShutdownTimeout: 200 * time.Millisecond,
+	}
+
+	hijacked := make(chan struct{})
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		close(hijacked)
+		io.Copy(io.Discard, conn)
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	addr, err := r.ListenAddr()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	<-hijacked
+
+	start := time.Now()
+	if err := r.Stop(ctx); !errors.Is(err, ErrShutdownTimeout) {
+		t.Error("want", ErrShutdownTimeout, "got", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Error("want about 200ms got", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("want EOF got", err)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	if err := joinErrors(nil, nil); err != nil {
+		t.Error("want nil got", err)
+	}
+	closeErr := errors.New("close fail")
+	if err := joinErrors(nil, closeErr); err != closeErr {
+		t.Error("want", closeErr, "got", err)
+	}
+
+	// 两个端点都超时, 其中一个关闭时还失败了
+	err := joinErrors(
+		joinErrors(nil, joinErrors(ErrShutdownTimeout, closeErr), nil),
+		joinErrors(nil, ErrShutdownTimeout, nil),
+		errors.New("hook fail"))
+	if !errors.Is(err, ErrShutdownTimeout) || !errors.Is(err, closeErr) {
+		t.Error("want ErrShutdownTimeout and close error got", err)
+	}
+	if !strings.Contains(err.Error(), "hook fail") {
+		t.Error("want hook fail got", err)
+	}
+}
+
+func TestRunnerUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket file mode isnot supported")
+	}
+
+	sockfile := filepath.Join(t.TempDir(), "app.sock")
+
+	// 模拟上次进程异常退出时遗留的 socket 文件
+	stale, err := net.Listen("unix", sockfile)
+	if err != nil {
+		t.Skip(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "unix",
+		ListenAt: sockfile,
+	}
+	r.UnixSocket.Mode = 0660
+
+	ctx := context.Background()
+	err = r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	fi, err := os.Stat(sockfile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("want 0660 got %o", fi.Mode().Perm())
+	}
+
+	if u, err := r.URL(); err == nil {
+		t.Error("want error got", u)
+	}
+
+	client := &http.Client{Transport: NewUnixSocketTransport(sockfile)}
+	response, err := client.Get("http://unix/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer response.Body.Close()
+	bs, _ := io.ReadAll(response.Body)
+	if string(bs) != "ok" {
+		t.Error("want ok got", string(bs))
+	}
+
+	// 正在使用的 socket 不能被删除
+	r2 := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "unix",
+		ListenAt: sockfile,
+	}
+	if err := r2.Start(ctx, http.NotFoundHandler()); err == nil {
+		r2.Stop(ctx)
+		t.Error("want error got ok")
+	}
+}
+
+func TestListenUnixPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("umask isnot supported")
+	}
+
+	dir := t.TempDir()
+	before := filepath.Join(dir, "before")
+	if err := os.WriteFile(before, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	sockfile := filepath.Join(dir, "app.sock")
+	_, ln, err := listenUnixPrivate(func() (string, net.Listener, error) {
+		return ListenAtDynamicPort("unix", sockfile, 0, 0)
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(sockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("want 0600 got %o", fi.Mode().Perm())
+	}
+
+	// umask 已经恢复
+	after := filepath.Join(dir, "after")
+	if err := os.WriteFile(after, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fi1, _ := os.Stat(before)
+	fi2, _ := os.Stat(after)
+	if fi1.Mode().Perm() != fi2.Mode().Perm() {
+		t.Errorf("want %o got %o", fi1.Mode().Perm(), fi2.Mode().Perm())
+	}
+}
+
+func TestRunnerEndpoints(t *testing.T) {
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "http",
+		ListenAt: "127.0.0.1:0",
+		Endpoints: []Endpoint{
+			{Name: "admin", Network: "http", ListenAt: "127.0.0.1:0"},
+		},
+	}
+
+	ctx := context.Background()
+	err := r.Start(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	mainURL, err := r.URL()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	adminURL, err := r.EndpointURL("admin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if mainURL == adminURL {
+		t.Error("want different url got", adminURL)
+	}
+
+	adminPort, err := r.ListenPort("admin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr, err := r.ListenAddr("admin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, port, _ := net.SplitHostPort(addr.String()); port != adminPort {
+		t.Error("want", adminPort, "got", port)
+	}
+
+	for _, u := range []string{mainURL, adminURL} {
+		response, err := http.Get(u)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		bs, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(bs) != "ok" {
+			t.Error("want ok got", string(bs))
+		}
+	}
+
+	if _, err := r.EndpointURL("notfound"); err == nil {
+		t.Error("want error got ok")
+	}
+
+	r2 := &Runner{
+		Logger: logtest.NewLogger(t),
+		Endpoints: []Endpoint{
+			{Name: "a", Network: "http", ListenAt: "127.0.0.1:0"},
+			{Name: "a", Network: "http", ListenAt: "127.0.0.1:0"},
+		},
+	}
+	if err := r2.Start(ctx, http.NotFoundHandler()); err == nil {
+		r2.Stop(ctx)
+		t.Error("want error got ok")
+	}
+}
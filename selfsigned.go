@@ -0,0 +1,311 @@
+package loong
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/runner-mei/errors"
+)
+
+// SelfSignedConfig 在 Dir 不为空并且证书文件不存在时自动生成一个本地 CA 和
+// 由它签发的服务器证书, 并保存在 Dir 中, 以后启动时会复用它们。
+// 客户端可以从 Dir 中的 ca.crt (tlcp 为 sm2-ca.crt) 导入 CA, 见 SelfSignedCAHandler
+//
+//	KeyType   TLS 证书的密钥类型, ecdsa (默认) 或 rsa, tlcp 总是使用 SM2
+//	Hosts     除了本机的主机名和所有网卡的地址之外, 证书中额外的 DNS 名称或 IP
+//	ValidFor  服务器证书的有效期, 默认为 DefaultSelfSignedValidFor
+type SelfSignedConfig struct {
+	Dir      string
+	KeyType  string
+	Hosts    []string
+	ValidFor time.Duration
+}
+
+// DefaultSelfSignedValidFor 是自签名服务器证书的默认有效期,
+// 部分浏览器不接受超过 825 天的证书
+var DefaultSelfSignedValidFor = 825 * 24 * time.Hour
+
+// selfSignedCAValidFor 是自签名 CA 的有效期
+var selfSignedCAValidFor = 10 * 365 * 24 * time.Hour
+
+const (
+	SelfSignedCAFile    = "ca.crt"
+	SelfSignedSM2CAFile = "sm2-ca.crt"
+)
+
+// certIssuer 封装了生成和解析密钥与证书的方法, 以便 TLS 和 tlcp (SM2) 共用签发的流程
+type certIssuer struct {
+	generateKey func() (crypto.Signer, error)
+	marshalKey  func(key crypto.Signer) ([]byte, error)
+	parseKey    func(der []byte) (crypto.Signer, error)
+	parseCert   func(der []byte) (*x509.Certificate, error)
+	createCert  func(template, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) ([]byte, error)
+}
+
+func tlsCertIssuer(keyType string) (*certIssuer, error) {
+	issuer := &certIssuer{
+		marshalKey: func(key crypto.Signer) ([]byte, error) {
+			return x509.MarshalPKCS8PrivateKey(key)
+		},
+		parseKey: func(der []byte) (crypto.Signer, error) {
+			key, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("private key isnot a signer")
+			}
+			return signer, nil
+		},
+		parseCert: x509.ParseCertificate,
+		createCert: func(template, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) ([]byte, error) {
+			return x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+		},
+	}
+
+	switch strings.ToLower(keyType) {
+	case "", "ecdsa", "ec":
+		issuer.generateKey = func() (crypto.Signer, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}
+	case "rsa":
+		issuer.generateKey = func() (crypto.Signer, error) {
+			return rsa.GenerateKey(rand.Reader, 2048)
+		}
+	default:
+		return nil, errors.New("self signed: key type '" + keyType + "' is unsupported")
+	}
+	return issuer, nil
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEMFile(filename, blockType string, der []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+func readPEMFile(filename string) ([]byte, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, errors.New("'" + filename + "' isnot a pem file")
+	}
+	return block.Bytes, nil
+}
+
+// loadOrCreateCA 加载 CA, 不存在时生成一个新的
+func (issuer *certIssuer) loadOrCreateCA(certFile, keyFile, commonName string) (*x509.Certificate, crypto.Signer, error) {
+	if fileExists(certFile) && fileExists(keyFile) {
+		certDer, err := readPEMFile(certFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert, err := issuer.parseCert(certDer)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "parse ca '"+certFile+"' fail")
+		}
+		keyDer, err := readPEMFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := issuer.parseKey(keyDer)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "parse ca key '"+keyFile+"' fail")
+		}
+		return cert, key, nil
+	}
+
+	key, err := issuer.generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName + " " + hostname, Organization: []string{"loong"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedCAValidFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := issuer.createCert(template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create ca fail")
+	}
+	cert, err := issuer.parseCert(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := issuer.marshalKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEMFile(keyFile, "PRIVATE KEY", keyDer, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEMFile(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// issue 用 CA 签发一个服务器证书并保存到 certFile 和 keyFile
+func (issuer *certIssuer) issue(ca *x509.Certificate, caKey crypto.Signer, config *SelfSignedConfig, keyUsage x509.KeyUsage, certFile, keyFile string) error {
+	key, err := issuer.generateKey()
+	if err != nil {
+		return err
+	}
+	// RSA 密钥交换需要 KeyEncipherment, 要按证书自己的密钥而不是 CA 的密钥判断,
+	// CA 可能是之前用其它的 KeyType 生成的
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return err
+	}
+	validFor := config.ValidFor
+	if validFor <= 0 {
+		validFor = DefaultSelfSignedValidFor
+	}
+
+	dnsNames, ipAddresses := selfSignedHosts(config.Hosts)
+	commonName := "localhost"
+	if len(dnsNames) > 0 {
+		commonName = dnsNames[0]
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"loong"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     keyUsage,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ipAddresses,
+	}
+	der, err := issuer.createCert(template, ca, key.Public(), caKey)
+	if err != nil {
+		return errors.Wrap(err, "create certificate fail")
+	}
+	keyDer, err := issuer.marshalKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEMFile(keyFile, "PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePEMFile(certFile, "CERTIFICATE", der, 0644)
+}
+
+// selfSignedHosts 返回证书中的 SAN, 包括 localhost, 本机的主机名, 所有网卡的地址和 hosts
+func selfSignedHosts(hosts []string) ([]string, []net.IP) {
+	var dnsNames []string
+	var ipAddresses []net.IP
+	seen := map[string]bool{}
+	add := func(host string) {
+		host = strings.TrimSpace(host)
+		if host == "" || seen[host] {
+			return
+		}
+		seen[host] = true
+		if ip := net.ParseIP(host); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, host)
+		}
+	}
+
+	for _, host := range hosts {
+		add(host)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		add(hostname)
+	}
+	add("localhost")
+	add("127.0.0.1")
+	add("::1")
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				add(ipnet.IP.String())
+			}
+		}
+	}
+	return dnsNames, ipAddresses
+}
+
+// ensureSelfSignedTLS 在证书文件不存在时生成它们, certFile 和 keyFile 为空时使用 Dir 中的 server.crt 和 server.key
+func ensureSelfSignedTLS(config *SelfSignedConfig, certFile, keyFile *string) error {
+	if *certFile == "" {
+		*certFile = filepath.Join(config.Dir, "server.crt")
+	}
+	if *keyFile == "" {
+		*keyFile = filepath.Join(config.Dir, "server.key")
+	}
+	if fileExists(*certFile) && fileExists(*keyFile) {
+		return nil
+	}
+
+	issuer, err := tlsCertIssuer(config.KeyType)
+	if err != nil {
+		return err
+	}
+	ca, caKey, err := issuer.loadOrCreateCA(filepath.Join(config.Dir, SelfSignedCAFile), filepath.Join(config.Dir, "ca.key"), "loong local ca")
+	if err != nil {
+		return err
+	}
+
+	return issuer.issue(ca, caKey, config, x509.KeyUsageDigitalSignature, *certFile, *keyFile)
+}
+
+// SelfSignedCAHandler 提供自签名 CA 证书的下载, 以便客户端导入并信任它
+func SelfSignedCAHandler(dir string, sm2 ...bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := SelfSignedCAFile
+		if len(sm2) > 0 && sm2[0] {
+			name = SelfSignedSM2CAFile
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			http.Error(w, "ca isnot found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+		w.Write(bs)
+	})
+}
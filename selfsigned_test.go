@@ -0,0 +1,130 @@
+package loong
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestRunnerSelfSigned(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "certs")
+
+	for _, keyType := range []string{"ecdsa", "rsa"} {
+		os.RemoveAll(dir)
+
+		var caPEM []byte
+		for i := 0; i < 2; i++ {
+			r := &Runner{
+				Logger:     logtest.NewLogger(t),
+				Network:    "https",
+				ListenAt:   "127.0.0.1:0",
+				SelfSigned: SelfSignedConfig{Dir: dir, KeyType: keyType},
+			}
+			ctx := context.Background()
+			err := r.Start(ctx, http.NotFoundHandler())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			bs, err := os.ReadFile(filepath.Join(dir, SelfSignedCAFile))
+			if err != nil {
+				t.Error(err)
+				r.Stop(ctx)
+				return
+			}
+			// 再次启动时复用已有的 CA
+			if caPEM != nil && !bytes.Equal(caPEM, bs) {
+				t.Error("ca is regenerated")
+			}
+			caPEM = bs
+
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(caPEM)
+			u, _ := r.URL()
+			for _, serverName := range []string{"localhost", ""} {
+				client := &http.Client{Transport: &http.Transport{
+					TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: serverName},
+					DisableKeepAlives: true,
+				}}
+				response, err := client.Get(u)
+				if err != nil {
+					t.Error(keyType, serverName, err)
+					continue
+				}
+				response.Body.Close()
+			}
+			r.Stop(ctx)
+		}
+
+		if fi, err := os.Stat(filepath.Join(dir, "server.key")); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != 0600 {
+			t.Errorf("want 0600 got %o", fi.Mode().Perm())
+		}
+
+		rec := httptest.NewRecorder()
+		SelfSignedCAHandler(dir).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ca.crt", nil))
+		if !bytes.Equal(rec.Body.Bytes(), caPEM) {
+			t.Error("ca isnot exported")
+		}
+	}
+
+	r := &Runner{
+		Logger:     logtest.NewLogger(t),
+		Network:    "https",
+		ListenAt:   "127.0.0.1:0",
+		SelfSigned: SelfSignedConfig{Dir: filepath.Join(t.TempDir(), "certs"), KeyType: "dsa"},
+	}
+	if err := r.Start(context.Background(), http.NotFoundHandler()); err == nil {
+		r.Stop(context.Background())
+		t.Error("want error got ok")
+	}
+}
+
+func TestSelfSignedKeyUsage(t *testing.T) {
+	// CA 是之前用另一种 KeyType 生成的
+	for _, test := range []struct {
+		caKeyType    string
+		keyType      string
+		encipherment bool
+	}{
+		{caKeyType: "rsa", keyType: "ecdsa", encipherment: false},
+		{caKeyType: "ecdsa", keyType: "rsa", encipherment: true},
+	} {
+		dir := t.TempDir()
+		certFile := filepath.Join(dir, "server.crt")
+		keyFile := filepath.Join(dir, "server.key")
+		if err := ensureSelfSignedTLS(&SelfSignedConfig{Dir: dir, KeyType: test.caKeyType}, &certFile, &keyFile); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(certFile)
+		os.Remove(keyFile)
+		if err := ensureSelfSignedTLS(&SelfSignedConfig{Dir: dir, KeyType: test.keyType}, &certFile, &keyFile); err != nil {
+			t.Fatal(err)
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0; got != test.encipherment {
+			t.Error(test.keyType, "want key encipherment", test.encipherment, "got", got)
+		}
+		if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+			t.Error(test.keyType, "want digital signature")
+		}
+	}
+}
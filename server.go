@@ -10,7 +10,6 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
-	"time"
 )
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -27,7 +26,7 @@ func (ln TcpKeepAliveListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(3 * time.Minute)
+	tc.SetKeepAlivePeriod(DefaultTCPKeepAlive)
 	return tc, nil
 }
 
@@ -115,10 +114,27 @@ func ListenAtDynamicPort(network, address string, portStart, portEnd int) (strin
 	case "https", "tls", "ssl":
 		// isHTTPs = true
 		network = "tcp"
+	case "unix":
+		network = "unix"
 	default:
 		return "", nil, errors.New("listen: network '" + network + "' is unsupported")
 	}
 
+	if ln, ok, err := takeActivatedListener(address); ok {
+		if err != nil {
+			return "", nil, err
+		}
+		return ln.Addr().String(), ln, nil
+	}
+
+	if network == "unix" {
+		ln, err := listenUnix(address)
+		if err != nil {
+			return "", nil, err
+		}
+		return address, ln, nil
+	}
+
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
 		return "", nil, err
@@ -121,3 +121,18 @@ func SetCipherSuitesWithNames(cfg *tls.Config, values []string) {
 		}
 	}
 }
+
+// lookupCipherSuite 返回密码套件的 ID 以及它是否是不安全的
+func lookupCipherSuite(name string) (id uint16, insecure, ok bool) {
+	for _, cipherSuite := range CipherSuites() {
+		if cipherSuite.Name == name {
+			return cipherSuite.ID, false, true
+		}
+	}
+	for _, cipherSuite := range InsecureCipherSuites() {
+		if cipherSuite.Name == name {
+			return cipherSuite.ID, true, true
+		}
+	}
+	return 0, false, false
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package loong
+
+import (
+	"os"
+	"syscall"
+)
+
+var sigReloadCertificates os.Signal = syscall.SIGUSR1
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package loong
+
+import (
+	"os"
+	"syscall"
+)
+
+// windows 中没有 SIGUSR1, 需要调用者指定信号
+var sigReloadCertificates os.Signal = syscall.SIGHUP
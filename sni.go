@@ -0,0 +1,181 @@
+package loong
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/runner-mei/errors"
+)
+
+// SNIConfig 按 SNI 中的主机名选择证书, 没有匹配的证书时使用端点的 CertFile/KeyFile
+// (tlcp 时为 TLCP 中的证书)。主机名不区分大小写, 可以用 *.example.com 匹配一级子域名。
+//
+// Dir 中的文件按下面的规则命名, 通配符的 * 用 _ 代替, 如 _.example.com.crt:
+//
+//	https  <host>.crt 和 <host>.key
+//	tlcp   <host>.sig.crt, <host>.sig.key, <host>.enc.crt 和 <host>.enc.key
+//
+// Certificates 中的证书优先于 Dir 中的证书, 没有 CertFile/KeyFile 的主机不用于 https,
+// 没有 TLCP 的主机不用于 tlcp, 所以 auto 端点可以混用两种证书。重新加载证书时
+// (见 Runner.ReloadCertificates) 会重新扫描 Dir, 所以添加新的域名不需要重启
+type SNIConfig struct {
+	Dir          string
+	Certificates map[string]SNICertificate
+}
+
+type SNICertificate struct {
+	CertFile string
+	KeyFile  string
+	TLCP     TLCPConfig
+}
+
+func (c *SNIConfig) IsEmpty() bool {
+	return c.Dir == "" && len(c.Certificates) == 0
+}
+
+// entries 返回所有的主机名和它的证书文件, 以及需要监视的文件
+func (c *SNIConfig) entries(isTLCP bool) (map[string]SNICertificate, []string, error) {
+	results := map[string]SNICertificate{}
+	var files []string
+
+	if c.Dir != "" {
+		names, err := os.ReadDir(c.Dir)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read sni dir '"+c.Dir+"' fail")
+		}
+		// 目录本身的修改时间在添加或删除文件时会变化
+		files = append(files, c.Dir)
+
+		suffix := ".crt"
+		if isTLCP {
+			suffix = ".sig.crt"
+		}
+		for _, entry := range names {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+				continue
+			}
+			// 同一个目录中可以同时有 https 和 tlcp 的证书, tlcp 的证书也以 .crt 结尾
+			if !isTLCP && (strings.HasSuffix(entry.Name(), ".sig.crt") || strings.HasSuffix(entry.Name(), ".enc.crt")) {
+				continue
+			}
+			base := strings.TrimSuffix(entry.Name(), suffix)
+			host := base
+			if strings.HasPrefix(host, "_.") {
+				host = "*" + strings.TrimPrefix(host, "_")
+			}
+
+			prefix := filepath.Join(c.Dir, base)
+			var cert SNICertificate
+			if isTLCP {
+				cert.TLCP = TLCPConfig{
+					SigCertFile: prefix + ".sig.crt",
+					SigKeyFile:  prefix + ".sig.key",
+					EncCertFile: prefix + ".enc.crt",
+					EncKeyFile:  prefix + ".enc.key",
+				}
+			} else {
+				cert.CertFile = prefix + ".crt"
+				cert.KeyFile = prefix + ".key"
+			}
+			results[strings.ToLower(host)] = cert
+		}
+	}
+
+	for host, cert := range c.Certificates {
+		// Certificates 由 https 和 tlcp 共用, 主机可以只有其中一种证书
+		if isTLCP && cert.TLCP == (TLCPConfig{}) || !isTLCP && cert.CertFile == "" && cert.KeyFile == "" {
+			continue
+		}
+		results[strings.ToLower(host)] = cert
+	}
+
+	for _, cert := range results {
+		if isTLCP {
+			files = append(files, cert.TLCP.SigCertFile, cert.TLCP.SigKeyFile, cert.TLCP.EncCertFile, cert.TLCP.EncKeyFile)
+		} else {
+			files = append(files, cert.CertFile, cert.KeyFile)
+		}
+	}
+	sort.Strings(files)
+	return results, files, nil
+}
+
+// matchServerName 按主机名查找, 先精确匹配, 再匹配 *.example.com 形式的通配符
+func matchServerName[T any](m map[string]T, serverName string) (T, bool) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+	if idx := strings.IndexByte(name, '.'); idx > 0 {
+		if v, ok := m["*"+name[idx:]]; ok {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// sniCertificates 是 https 端点的 SNI 证书
+type sniCertificates struct {
+	config   SNIConfig
+	fallback *CertificateReloader
+	certs    atomic.Pointer[map[string]*tls.Certificate]
+}
+
+func newSNICertificates(config SNIConfig, fallback *CertificateReloader) (*sniCertificates, error) {
+	c := &sniCertificates{config: config, fallback: fallback}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sniCertificates) Files() []string {
+	_, files, _ := c.config.entries(false)
+	return files
+}
+
+// Reload 重新加载所有的证书, 某个主机的证书无效或已过期时继续使用它原来的证书并返回错误
+func (c *sniCertificates) Reload() error {
+	entries, _, err := c.config.entries(false)
+	if err != nil {
+		return err
+	}
+
+	var old map[string]*tls.Certificate
+	if p := c.certs.Load(); p != nil {
+		old = *p
+	}
+
+	certs := map[string]*tls.Certificate{}
+	for host, entry := range entries {
+		cert, e := LoadX509KeyPair(entry.CertFile, entry.KeyFile)
+		if e == nil && old[host] != nil {
+			e = checkCertificateExpiry(&cert, entry.CertFile)
+		}
+		if e != nil {
+			err = errors.Join(err, errors.Wrap(e, "sni '"+host+"'"))
+			if o, ok := old[host]; ok {
+				certs[host] = o
+			}
+			continue
+		}
+		certs[host] = &cert
+	}
+	c.certs.Store(&certs)
+	return err
+}
+
+func (c *sniCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := matchServerName(*c.certs.Load(), hello.ServerName); ok {
+		return cert, nil
+	}
+	if c.fallback != nil {
+		return c.fallback.GetCertificate(hello)
+	}
+	return nil, errors.New("no certificate for server name '" + hello.ServerName + "'")
+}
@@ -0,0 +1,197 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestMatchServerName(t *testing.T) {
+	m := map[string]int{
+		"a.example.com":   1,
+		"*.example.com":   2,
+		"*.b.example.com": 3,
+	}
+	for _, test := range []struct {
+		name  string
+		value int
+	}{
+		{name: "a.example.com", value: 1},
+		{name: "A.Example.COM.", value: 1},
+		{name: "c.example.com", value: 2},
+		{name: "x.b.example.com", value: 3},
+		{name: "x.y.example.com", value: 0},
+		{name: "example.com", value: 0},
+		{name: "", value: 0},
+	} {
+		if v, _ := matchServerName(m, test.name); v != test.value {
+			t.Error(test.name, ": want", test.value, "got", v)
+		}
+	}
+}
+
+func TestSNIConfigEntries(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"a.example.com.crt", "a.example.com.key",
+		"_.example.org.crt", "_.example.org.key",
+		"b.example.com.sig.crt", "b.example.com.sig.key",
+		"b.example.com.enc.crt", "b.example.com.enc.key",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := SNIConfig{Dir: dir}
+
+	entries, _, err := config.entries(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Error("want 2 entries got", entries)
+	}
+	if cert := entries["a.example.com"]; cert.CertFile != filepath.Join(dir, "a.example.com.crt") ||
+		cert.KeyFile != filepath.Join(dir, "a.example.com.key") {
+		t.Error("a.example.com is", cert)
+	}
+	if _, ok := entries["*.example.org"]; !ok {
+		t.Error("*.example.org is missing")
+	}
+
+	entries, _, err = config.entries(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Error("want 1 entry got", entries)
+	}
+	if cert := entries["b.example.com"]; cert.TLCP.SigCertFile != filepath.Join(dir, "b.example.com.sig.crt") ||
+		cert.TLCP.EncKeyFile != filepath.Join(dir, "b.example.com.enc.key") {
+		t.Error("b.example.com is", cert)
+	}
+}
+
+func TestSNIConfigEntriesMixed(t *testing.T) {
+	config := SNIConfig{Certificates: map[string]SNICertificate{
+		"a.example.com": {CertFile: "a.crt", KeyFile: "a.key"},
+		"b.example.com": {TLCP: TLCPConfig{SigCertFile: "b.sig.crt", SigKeyFile: "b.sig.key", EncCertFile: "b.enc.crt", EncKeyFile: "b.enc.key"}},
+		"c.example.com": {CertFile: "c.crt", KeyFile: "c.key", TLCP: TLCPConfig{SigCertFile: "c.sig.crt", SigKeyFile: "c.sig.key", EncCertFile: "c.enc.crt", EncKeyFile: "c.enc.key"}},
+	}}
+
+	for _, test := range []struct {
+		isTLCP bool
+		hosts  []string
+	}{
+		{isTLCP: false, hosts: []string{"a.example.com", "c.example.com"}},
+		{isTLCP: true, hosts: []string{"b.example.com", "c.example.com"}},
+	} {
+		entries, files, err := config.entries(test.isTLCP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(test.hosts) {
+			t.Error(test.isTLCP, ": want", test.hosts, "got", entries)
+		}
+		for _, host := range test.hosts {
+			if _, ok := entries[host]; !ok {
+				t.Error(test.isTLCP, ":", host, "is missing")
+			}
+		}
+		for _, file := range files {
+			if file == "" {
+				t.Error(test.isTLCP, ": empty file in", files)
+			}
+		}
+	}
+}
+
+func TestRunnerSNI(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "default.crt")
+	keyFile := filepath.Join(dir, "default.key")
+	writeTestCertificate(t, certFile, keyFile, 1, time.Now().Add(time.Hour))
+
+	sniDir := filepath.Join(dir, "sni")
+	if err := os.MkdirAll(sniDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, filepath.Join(sniDir, "a.example.com.crt"), filepath.Join(sniDir, "a.example.com.key"), 10, time.Now().Add(time.Hour))
+	writeTestCertificate(t, filepath.Join(sniDir, "_.example.org.crt"), filepath.Join(sniDir, "_.example.org.key"), 20, time.Now().Add(time.Hour))
+	// tlcp 的证书不影响 https
+	for _, name := range []string{"b.example.com.sig.crt", "b.example.com.sig.key", "b.example.com.enc.crt", "b.example.com.enc.key"} {
+		if err := os.WriteFile(filepath.Join(sniDir, name), []byte("not a tls certificate"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &Runner{
+		Logger:   logtest.NewLogger(t),
+		Network:  "https",
+		ListenAt: "127.0.0.1:0",
+		KeyFile:  keyFile,
+		CertFile: certFile,
+		SNI:      SNIConfig{Dir: sniDir},
+	}
+	ctx := context.Background()
+	err := r.Start(ctx, http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Stop(ctx)
+
+	addr, err := r.ListenAddr()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serial := func(serverName string) int64 {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr.String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	for name, want := range map[string]int64{
+		"a.example.com":   10,
+		"www.example.org": 20,
+		"other.com":       1,
+		"new.example.net": 1,
+	} {
+		if s := serial(name); s != want {
+			t.Error(name, ": want", want, "got", s)
+		}
+	}
+
+	writeTestCertificate(t, filepath.Join(sniDir, "new.example.net.crt"), filepath.Join(sniDir, "new.example.net.key"), 30, time.Now().Add(time.Hour))
+	if err := r.ReloadCertificates(); err != nil {
+		t.Error(err)
+	}
+	if s := serial("new.example.net"); s != 30 {
+		t.Error("want 30 got", s)
+	}
+
+	// 已过期的证书不会替换原来的证书
+	writeTestCertificate(t, filepath.Join(sniDir, "a.example.com.crt"), filepath.Join(sniDir, "a.example.com.key"), 11, time.Now().Add(-time.Hour))
+	if err := r.ReloadCertificates(); err == nil {
+		t.Error("want error got ok")
+	}
+	if s := serial("a.example.com"); s != 10 {
+		t.Error("want 10 got", s)
+	}
+}
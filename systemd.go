@@ -0,0 +1,204 @@
+package loong
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+// systemd socket activation 传过来的 fd 从 3 开始,
+// 见 https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+const sdListenFdsStart = 3
+
+var (
+	sdListenOnce  sync.Once
+	sdListenLock  sync.Mutex
+	sdListenFiles []*os.File
+	sdListenNames []string
+)
+
+func loadSystemdListeners() {
+	sdListenOnce.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			return
+		}
+
+		var names []string
+		if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+			names = strings.Split(s, ":")
+		}
+
+		sdListenFiles = make([]*os.File, count)
+		sdListenNames = make([]string, count)
+		for i := 0; i < count; i++ {
+			name := "LISTEN_FD_" + strconv.Itoa(sdListenFdsStart+i)
+			if i < len(names) {
+				name = names[i]
+			}
+			sdListenNames[i] = name
+			sdListenFiles[i] = os.NewFile(uintptr(sdListenFdsStart+i), name)
+		}
+	})
+}
+
+// IsActivatedAddress 判断地址是否为 "systemd:name" 或 "fd:3" 形式
+func IsActivatedAddress(address string) bool {
+	return address == "systemd" || strings.HasPrefix(address, "systemd:") || strings.HasPrefix(address, "fd:")
+}
+
+// takeActivatedListener 从 systemd socket activation 或指定的 fd 中取得 socket,
+// address 的格式为:
+//
+//	systemd        第一个未被使用的 socket
+//	systemd:name   LISTEN_FDNAMES 中名为 name 的 socket (即 unit 中的 FileDescriptorName)
+//	fd:3           fd 为 3 的 socket
+func takeActivatedListener(address string) (net.Listener, bool, error) {
+	if !IsActivatedAddress(address) {
+		return nil, false, nil
+	}
+
+	if strings.HasPrefix(address, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(address, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, true, errors.New("listen: fd '" + address + "' is invalid")
+		}
+		f := os.NewFile(uintptr(fd), address)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, true, errors.Wrap(err, "listen at '"+address+"' fail")
+		}
+		return ln, true, nil
+	}
+
+	loadSystemdListeners()
+
+	sdListenLock.Lock()
+	defer sdListenLock.Unlock()
+
+	name := strings.TrimPrefix(strings.TrimPrefix(address, "systemd"), ":")
+	for idx, f := range sdListenFiles {
+		if f == nil {
+			continue
+		}
+		if name != "" && sdListenNames[idx] != name {
+			continue
+		}
+		sdListenFiles[idx] = nil
+
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, true, errors.Wrap(err, "listen at '"+address+"' fail")
+		}
+		return ln, true, nil
+	}
+	return nil, true, errors.New("listen: socket '" + address + "' isnot passed by systemd")
+}
+
+// SdNotify 向 systemd 发送状态通知, 如 "READY=1", 当进程不是由 systemd
+// 启动 (没有 NOTIFY_SOCKET) 时返回 false
+func SdNotify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdogInterval 返回 systemd 要求的 watchdog 间隔, 没有启用时返回 0
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if s := os.Getenv("WATCHDOG_PID"); s != "" {
+		if pid, err := strconv.Atoi(s); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func (r *Runner) sdNotifyReady() {
+	// 通过 Restart 重启后, 新进程需要告诉 systemd 主进程变了
+	if ok, err := SdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())); err != nil {
+		r.Logger.Warn("sd_notify READY fail", log.Error(err))
+	} else if !ok {
+		return
+	}
+
+	interval := SdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.lock.Lock()
+	r.sdWatchdogCancel = cancel
+	r.lock.Unlock()
+
+	go func() {
+		// 按 systemd 的建议, 以一半的间隔发送
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := SdNotify("WATCHDOG=1"); err != nil {
+					r.Logger.Warn("sd_notify WATCHDOG fail", log.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// sdNotifyStopping 停止 watchdog 并通知 systemd 服务正在停止。handoff 时新进程已经
+// 通过 MAINPID 成为了主进程, 这时发送 STOPPING (NotifyAccess=all) 会让 systemd 认为
+// 整个服务在停止, 所以不发送
+func (r *Runner) sdNotifyStopping(handoff bool) {
+	r.lock.Lock()
+	cancel := r.sdWatchdogCancel
+	r.sdWatchdogCancel = nil
+	r.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if handoff {
+		return
+	}
+	if _, err := SdNotify("STOPPING=1"); err != nil {
+		r.Logger.Warn("sd_notify STOPPING fail", log.Error(err))
+	}
+}
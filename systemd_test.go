@@ -0,0 +1,143 @@
+//go:build !windows
+// +build !windows
+
+package loong
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestTakeActivatedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ln.Close()
+
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// takeActivatedListener 会关闭 fd, 所以给它一个单独的 fd
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	activated, ok, err := takeActivatedListener("fd:" + strconv.Itoa(fd))
+	if !ok || err != nil {
+		t.Error("want ok got", ok, err)
+		return
+	}
+	defer activated.Close()
+
+	if activated.Addr().String() != ln.Addr().String() {
+		t.Error("want", ln.Addr(), "got", activated.Addr())
+	}
+
+	if _, ok, _ := takeActivatedListener("127.0.0.1:0"); ok {
+		t.Error("want not activated address")
+	}
+	if _, ok, err := takeActivatedListener("systemd:notexists"); !ok || err == nil {
+		t.Error("want error got", ok, err)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	if ok, err := SdNotify("READY=1"); ok || err != nil {
+		t.Skip("NOTIFY_SOCKET is set")
+	}
+
+	addr := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	defer os.Remove(addr)
+
+	t.Setenv("NOTIFY_SOCKET", addr)
+	ok, err := SdNotify("READY=1")
+	if !ok || err != nil {
+		t.Error("want ok got", ok, err)
+		return
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Error("want READY=1 got", string(buf[:n]))
+	}
+}
+
+func TestRunnerSdNotifyHandoff(t *testing.T) {
+	if ok, err := SdNotify("READY=1"); ok || err != nil {
+		t.Skip("NOTIFY_SOCKET is set")
+	}
+
+	addr := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", addr)
+
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 128)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+
+	ctx := context.Background()
+	for _, handoff := range []bool{true, false} {
+		r := &Runner{
+			Logger:   logtest.NewLogger(t),
+			Network:  "http",
+			ListenAt: "127.0.0.1:0",
+		}
+		if err := r.Start(ctx, http.NotFoundHandler()); err != nil {
+			t.Error(err)
+			return
+		}
+		if msg := read(); !strings.HasPrefix(msg, "READY=1\nMAINPID=") {
+			t.Error("want READY got", msg)
+		}
+
+		if err := r.stop(ctx, handoff); err != nil {
+			t.Error(err)
+		}
+		msg := read()
+		if handoff {
+			// 新进程已经是主进程了, 不能通知 systemd 服务在停止
+			if msg != "" {
+				t.Error("want nothing got", msg)
+			}
+		} else if msg != "STOPPING=1" {
+			t.Error("want STOPPING=1 got", msg)
+		}
+	}
+}
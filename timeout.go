@@ -0,0 +1,285 @@
+package loong
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/log"
+)
+
+var ErrRequestTimeout = errors.New("request timeout")
+
+const (
+	SpanTagTimeout  = "http.timeout"
+	SpanTagTimedOut = "http.timed_out"
+)
+
+// TimeoutConfig defines the config for Timeout middleware.
+type TimeoutConfig struct {
+	// Timeout 是请求的处理时间, 默认是 30s
+	Timeout time.Duration
+
+	// StatusCode 是超时时响应的状态码, 503 (默认) 或 504
+	StatusCode int
+
+	// Skipper 返回 true 时不限制请求的处理时间
+	Skipper func(c *Context) bool
+}
+
+var DefaultTimeoutConfig = TimeoutConfig{
+	Timeout:    30 * time.Second,
+	StatusCode: http.StatusServiceUnavailable,
+}
+
+// Timeout returns a middleware which sets a deadline on StdContext, see TimeoutWithConfig.
+func Timeout(timeout time.Duration) MiddlewareFunc {
+	return TimeoutWithConfig(TimeoutConfig{Timeout: timeout})
+}
+
+// TimeoutWithConfig 返回一个限制请求处理时间的 middleware, 它一般用于单个路由。
+//
+// 它在 StdContext 和请求的 context 上设置 deadline, handler 仍然在当前的 goroutine 中
+// 执行, 它需要通过 context 感知超时并尽快返回 (如数据库查询会被取消)。到期时如果
+// handler 还没有写响应, 立即返回 503/504 的 Result; 之后 handler 的所有写操作都被
+// 丢弃并返回 http.ErrHandlerTimeout。
+//
+// handler 可以在超时之前接管连接 (如 websocket), 接管之后不再写超时的响应, 但是
+// context 的 deadline 仍然有效; 超时之后接管连接返回 http.ErrHandlerTimeout。
+func TimeoutWithConfig(config TimeoutConfig) MiddlewareFunc {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeoutConfig.Timeout
+	}
+	if config.StatusCode == 0 {
+		config.StatusCode = DefaultTimeoutConfig.StatusCode
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if config.Skipper != nil && config.Skipper(c) {
+				return next(c)
+			}
+
+			// 超时的响应在另一个 goroutine 中写, 不能访问 c, 所以先准备好
+			body, err := json.Marshal(c.errorResult(ErrRequestTimeout, config.StatusCode))
+			if err != nil {
+				return err
+			}
+
+			logger := c.logger()
+			span := opentracing.SpanFromContext(c.StdContext)
+			if span != nil {
+				span.SetTag(SpanTagTimeout, config.Timeout.String())
+			}
+
+			ctx, cancel := context.WithTimeout(c.StdContext, config.Timeout)
+			defer cancel()
+			c.StdContext = ctx
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			resp := c.Response()
+			tw := &timeoutWriter{
+				ResponseWriter: resp.Writer,
+				header:         resp.Writer.Header().Clone(),
+				ctx:            ctx,
+				code:           config.StatusCode,
+				body:           body,
+			}
+			resp.Writer = tw
+
+			// handler 返回后关闭 done, 然后等待 goroutine 退出, 它退出后不会再访问 tw
+			done := make(chan struct{})
+			fired := make(chan struct{})
+			stopped := false
+			stop := func() {
+				if !stopped {
+					stopped = true
+					close(done)
+					<-fired
+				}
+			}
+			// handler panic 时也要先等待 goroutine 退出再恢复 ResponseWriter, 否则
+			// recover 的 middleware 可能和超时的响应同时写
+			defer func() {
+				stop()
+				resp.Writer = tw.ResponseWriter
+				if _, written := tw.state(); written {
+					resp.Status = config.StatusCode
+					resp.Size = int64(len(body))
+					resp.Committed = true
+				}
+			}()
+
+			go func() {
+				defer close(fired)
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+				}
+				if ctx.Err() != context.DeadlineExceeded {
+					return
+				}
+
+				written, hijacked := tw.timeout()
+				if hijacked {
+					return
+				}
+				if span != nil {
+					span.SetTag(SpanTagTimedOut, true)
+				}
+				logger.Warn("request timeout",
+					log.Duration("timeout", config.Timeout),
+					log.Bool("partial_response", !written))
+			}()
+
+			err = next(c)
+
+			stop()
+			timedOut, _ := tw.state()
+			if !timedOut {
+				return err
+			}
+
+			if err != nil {
+				logger.Info("handler returned after the request timed out", log.Error(err))
+			}
+			return nil
+		}
+	}
+}
+
+// timeoutWriter 保证超时的响应和 handler 的写操作不会同时发生, handler 使用自己的
+// header, 只在 WriteHeader 时复制到真正的 ResponseWriter 中
+type timeoutWriter struct {
+	http.ResponseWriter
+	header http.Header
+
+	ctx  context.Context
+	code int
+	body []byte
+
+	lock         sync.Mutex
+	wroteHeader  bool
+	hijacked     bool
+	timedOut     bool
+	wroteTimeout bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) Write(bs []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.expiredLocked() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !w.wroteHeader {
+		w.writeHeaderLocked(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(bs)
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.expiredLocked() || w.wroteHeader {
+		return
+	}
+	w.writeHeaderLocked(code)
+}
+
+func (w *timeoutWriter) writeHeaderLocked(code int) {
+	dst := w.ResponseWriter.Header()
+	for key, values := range w.header {
+		dst[key] = values
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.expiredLocked() {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.expiredLocked() {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("timeout: response writer does not support hijack")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return conn, rw, nil
+}
+
+// expiredLocked 返回请求是否已超时, handler 可能在超时的 goroutine 执行之前就感知到了
+// context 到期, 所以这里也检查 deadline
+func (w *timeoutWriter) expiredLocked() bool {
+	if !w.timedOut && w.ctx.Err() == context.DeadlineExceeded {
+		w.timeoutLocked()
+	}
+	return w.timedOut
+}
+
+// timeout 标记请求已超时, 返回是否写了超时的响应以及连接是否已被接管
+func (w *timeoutWriter) timeout() (written, hijacked bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.timedOut {
+		w.timeoutLocked()
+	}
+	return w.wroteTimeout, w.hijacked
+}
+
+func (w *timeoutWriter) timeoutLocked() {
+	w.timedOut = true
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+
+	header := w.ResponseWriter.Header()
+	header.Set(HeaderContentType, MIMEApplicationJSONCharsetUTF8)
+	header.Set(HeaderContentLength, strconv.Itoa(len(w.body)))
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(w.body)
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	w.wroteHeader = true
+	w.wroteTimeout = true
+}
+
+func (w *timeoutWriter) state() (timedOut, wroteTimeout bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.timedOut, w.wroteTimeout
+}
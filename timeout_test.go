@@ -0,0 +1,188 @@
+package loong
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	tracer := mocktracer.New()
+	lateWrite := make(chan error, 1)
+	release := make(chan struct{})
+
+	e := New()
+	e.GET("/fast", func(c *Context) error {
+		if _, ok := c.StdContext.Deadline(); !ok {
+			t.Error("want deadline")
+		}
+		return c.String(http.StatusOK, "ok")
+	}, Timeout(time.Second))
+	e.GET("/cancel", func(c *Context) error {
+		<-c.Request().Context().Done()
+		if err := c.StdContext.Err(); err != context.DeadlineExceeded {
+			t.Error("want deadline exceeded got", err)
+		}
+		_, err := io.WriteString(c.Response(), "late")
+		lateWrite <- err
+		return c.StdContext.Err()
+	}, Timeout(50*time.Millisecond))
+	e.GET("/ignore", func(c *Context) error {
+		// 不理会 context 的 handler 不能阻止超时的响应
+		<-release
+		return c.String(http.StatusOK, "late")
+	}, TimeoutWithConfig(TimeoutConfig{Timeout: 50 * time.Millisecond, StatusCode: http.StatusGatewayTimeout}))
+	e.GET("/traced", func(c *Context) error {
+		span := tracer.StartSpan("traced")
+		defer span.Finish()
+		c.StdContext = opentracing.ContextWithSpan(c.StdContext, span)
+		return TimeoutWithConfig(TimeoutConfig{Timeout: 10 * time.Millisecond})(func(c *Context) error {
+			<-c.StdContext.Done()
+			return nil
+		})(c)
+	})
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		response, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		defer response.Body.Close()
+		bs, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		return response.StatusCode, string(bs)
+	}
+
+	if code, body := get("/fast"); code != http.StatusOK || body != "ok" {
+		t.Error(code, body)
+	}
+
+	code, body := get("/cancel")
+	if code != http.StatusServiceUnavailable {
+		t.Error("want 503 got", code, body)
+	}
+	var result Result
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Error(err)
+	} else if result.Success || result.Error == nil {
+		t.Error("want error result got", body)
+	}
+	if err := <-lateWrite; err != http.ErrHandlerTimeout {
+		t.Error("want ErrHandlerTimeout got", err)
+	}
+
+	start := time.Now()
+	code, body = get("/ignore")
+	if code != http.StatusGatewayTimeout {
+		t.Error("want 504 got", code, body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("response is delayed", elapsed)
+	}
+	close(release)
+
+	if code, _ := get("/traced"); code != http.StatusServiceUnavailable {
+		t.Error("want 503 got", code)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Error("want 1 span got", len(spans))
+	} else {
+		if tag := spans[0].Tag(SpanTagTimeout); tag != "10ms" {
+			t.Error("timeout tag is", tag)
+		}
+		if tag := spans[0].Tag(SpanTagTimedOut); tag != true {
+			t.Error("timed out tag is", tag)
+		}
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	e := New()
+	e.GET("/panic", func(c *Context) error {
+		<-c.StdContext.Done()
+		// 等超时的响应写完之后再 panic, recover 的 middleware 不能再写响应
+		time.Sleep(20 * time.Millisecond)
+		panic("boom")
+	}, Timeout(20*time.Millisecond))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("want 503 got", rec.Code)
+	}
+	var result Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Error(err, rec.Body.String())
+	} else if result.Error == nil || result.Error.Code != http.StatusServiceUnavailable {
+		t.Error("want timeout result got", rec.Body.String())
+	}
+}
+
+func TestTimeoutHijack(t *testing.T) {
+	lateHijack := make(chan error, 1)
+
+	e := New()
+	e.GET("/hijack", func(c *Context) error {
+		conn, _, err := c.Response().Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// 接管之后超时不再写响应
+		<-c.StdContext.Done()
+		time.Sleep(10 * time.Millisecond)
+		_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		return err
+	}, Timeout(20*time.Millisecond))
+	e.GET("/late", func(c *Context) error {
+		<-c.StdContext.Done()
+		_, _, err := c.Response().Hijack()
+		lateHijack <- err
+		return nil
+	}, Timeout(20*time.Millisecond))
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	response, err := http.Get(srv.URL + "/hijack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(bs) != "ok" {
+		t.Error("want ok got", response.StatusCode, string(bs))
+	}
+
+	response, err = http.Get(srv.URL + "/late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Error("want 503 got", response.StatusCode)
+	}
+	select {
+	case err := <-lateHijack:
+		if err != http.ErrHandlerTimeout {
+			t.Error("want ErrHandlerTimeout got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("hijack is not called")
+	}
+}
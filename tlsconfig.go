@@ -0,0 +1,135 @@
+package loong
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/runner-mei/errors"
+)
+
+// TLSConfig 是 https 端点的 TLS 参数, 为空的字段使用 crypto/tls 的默认值
+//
+//	MinVersion, MaxVersion 的值为 tls10, tls11, tls12 或 tls13
+//	CipherSuites 的值为 IANA 的名称, 如 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+//	             注意 TLS 1.3 的密码套件是不能配置的, 配置时会返回错误
+//	AllowInsecureCipherSuites 为 true 时 CipherSuites 中才可以使用
+//	             tls.InsecureCipherSuites() 中的密码套件 (如 RC4 和 CBC-SHA256)
+//	CurvePreferences 的值为 X25519, P256, P384 或 P521
+//	NextProtos 为 ALPN 的协议列表, 为空时为 h2 和 http/1.1
+type TLSConfig struct {
+	MinVersion                string
+	MaxVersion                string
+	CipherSuites              []string
+	AllowInsecureCipherSuites bool
+	CurvePreferences          []string
+	NextProtos                []string
+	DisableSessionTickets     bool
+}
+
+// IsEmpty 判断是否没有配置任何参数
+func (c *TLSConfig) IsEmpty() bool {
+	return c.MinVersion == "" && c.MaxVersion == "" &&
+		len(c.CipherSuites) == 0 && len(c.CurvePreferences) == 0 &&
+		len(c.NextProtos) == 0 && !c.DisableSessionTickets
+}
+
+// Build 校验参数并生成 tls.Config, 未知的版本、密码套件和曲线都会返回错误
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		SessionTicketsDisabled: c.DisableSessionTickets,
+	}
+
+	var err error
+	if c.MinVersion != "" {
+		cfg.MinVersion, err = ParseTlsVersion(strings.ToLower(c.MinVersion))
+		if err != nil {
+			return nil, errors.Wrap(err, "tls min version")
+		}
+	}
+	if c.MaxVersion != "" {
+		cfg.MaxVersion, err = ParseTlsVersion(strings.ToLower(c.MaxVersion))
+		if err != nil {
+			return nil, errors.Wrap(err, "tls max version")
+		}
+	}
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return nil, errors.New("tls min version '" + c.MinVersion + "' is greater than max version '" + c.MaxVersion + "'")
+	}
+
+	if len(c.CipherSuites) > 0 {
+		cfg.CipherSuites, err = parseCipherSuites(c.CipherSuites, c.AllowInsecureCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.CurvePreferences) > 0 {
+		cfg.CurvePreferences, err = ParseCurves(c.CurvePreferences)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.NextProtos) > 0 {
+		cfg.NextProtos = append([]string(nil), c.NextProtos...)
+	}
+	return cfg, nil
+}
+
+// ParseCipherSuites 将密码套件的名称转换为 ID, 和 SetCipherSuitesWithNames
+// 不同的是未知的名称、TLS 1.3 的密码套件和不安全的密码套件都会返回错误
+func ParseCipherSuites(values []string) ([]uint16, error) {
+	return parseCipherSuites(values, false)
+}
+
+func parseCipherSuites(values []string, allowInsecure bool) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range values {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		id, insecure, ok := lookupCipherSuite(name)
+		if !ok {
+			return nil, errors.New("cipher suite '" + name + "' is unsupported")
+		}
+		if isTLS13CipherSuite(id) {
+			return nil, errors.New("cipher suite '" + name + "' is a TLS 1.3 cipher suite, which is not configurable")
+		}
+		if insecure && !allowInsecure {
+			return nil, errors.New("cipher suite '" + name + "' is insecure, set AllowInsecureCipherSuites to use it")
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// isTLS13CipherSuite 判断是否是 TLS 1.3 的密码套件, crypto/tls 会忽略
+// tls.Config.CipherSuites 中的它们
+func isTLS13CipherSuite(id uint16) bool {
+	switch id {
+	case tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384, tls.TLS_CHACHA20_POLY1305_SHA256:
+		return true
+	}
+	return false
+}
+
+// ParseCurves 将曲线的名称转换为 tls.CurveID, 名称不区分大小写, P-256 和 P256 都可以
+func ParseCurves(values []string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range values {
+		switch strings.ToUpper(strings.Replace(strings.TrimSpace(name), "-", "", -1)) {
+		case "":
+			continue
+		case "X25519":
+			curves = append(curves, tls.X25519)
+		case "P256", "SECP256R1":
+			curves = append(curves, tls.CurveP256)
+		case "P384", "SECP384R1":
+			curves = append(curves, tls.CurveP384)
+		case "P521", "SECP521R1":
+			curves = append(curves, tls.CurveP521)
+		default:
+			return nil, errors.New("curve '" + name + "' is unsupported")
+		}
+	}
+	return curves, nil
+}
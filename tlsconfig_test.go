@@ -0,0 +1,105 @@
+package loong
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/runner-mei/log/logtest"
+)
+
+func TestTLSConfig(t *testing.T) {
+	c := TLSConfig{
+		MinVersion:            "tls12",
+		MaxVersion:            "TLS13",
+		CipherSuites:          []string{"tls_ecdhe_rsa_with_aes_128_gcm_sha256", " TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		CurvePreferences:      []string{"X25519", "P-256"},
+		DisableSessionTickets: true,
+	}
+	cfg, err := c.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS13 {
+		t.Error("version is invalid", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if len(cfg.CipherSuites) != 2 ||
+		cfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+		cfg.CipherSuites[1] != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Error("cipher suites is invalid", cfg.CipherSuites)
+	}
+	if len(cfg.CurvePreferences) != 2 ||
+		cfg.CurvePreferences[0] != tls.X25519 ||
+		cfg.CurvePreferences[1] != tls.CurveP256 {
+		t.Error("curves is invalid", cfg.CurvePreferences)
+	}
+	if !cfg.SessionTicketsDisabled {
+		t.Error("session tickets isnot disabled")
+	}
+
+	for _, c := range []TLSConfig{
+		{MinVersion: "tls14"},
+		{MinVersion: "tls13", MaxVersion: "tls12"},
+		{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NOT_EXISTS"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{CipherSuites: []string{"TLS_CHACHA20_POLY1305_SHA256"}, AllowInsecureCipherSuites: true},
+		{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_RC4_128_SHA"}},
+		{CurvePreferences: []string{"P224"}},
+	} {
+		if _, err := c.Build(); err == nil {
+			t.Error("want error got ok", c)
+		}
+	}
+}
+
+func TestTLSConfigInsecureCipherSuites(t *testing.T) {
+	c := TLSConfig{
+		CipherSuites:              []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_RC4_128_SHA"},
+		AllowInsecureCipherSuites: true,
+	}
+	cfg, err := c.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(cfg.CipherSuites) != 2 || cfg.CipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA {
+		t.Error("cipher suites is invalid", cfg.CipherSuites)
+	}
+
+	if _, err := ParseCipherSuites([]string{"TLS_RSA_WITH_AES_128_CBC_SHA256"}); err == nil || !strings.Contains(err.Error(), "insecure") {
+		t.Error("want insecure error got", err)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_AES_256_GCM_SHA384"}); err == nil || !strings.Contains(err.Error(), "TLS 1.3") {
+		t.Error("want TLS 1.3 error got", err)
+	}
+}
+
+func TestRunnerInvalidTLSConfig(t *testing.T) {
+	// 证书是有效的, 所以 Start 失败只能是因为 CipherSuites
+	r := &Runner{
+		Logger:     logtest.NewLogger(t),
+		Network:    "https",
+		ListenAt:   "127.0.0.1:0",
+		SelfSigned: SelfSignedConfig{Dir: t.TempDir()},
+	}
+	r.TLS.CipherSuites = []string{"TLS_NOT_EXISTS"}
+
+	ctx := context.Background()
+	err := r.Start(ctx, http.NotFoundHandler())
+	if err == nil {
+		r.Stop(ctx)
+		t.Fatal("want error got ok")
+	}
+	if !strings.Contains(err.Error(), "TLS_NOT_EXISTS") {
+		t.Error("want TLS_NOT_EXISTS error got", err)
+	}
+
+	r.TLS.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	if err := r.Start(ctx, http.NotFoundHandler()); err != nil {
+		t.Fatal(err)
+	}
+	r.Stop(ctx)
+}
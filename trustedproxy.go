@@ -0,0 +1,200 @@
+package loong
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies 是可信的反向代理的地址, 只有直接连接的对端 (RemoteAddr) 是可信的
+// 代理时才会使用 Forwarded (RFC 7239)、X-Forwarded-For、X-Real-IP、X-Forwarded-Proto
+// 和 X-Forwarded-Host 头。
+//
+// 客户端地址是从右向左遍历转发链, 跳过可信的代理之后的第一个地址, 所以客户端自己
+// 伪造的 X-Forwarded-For 不会生效。Forwarded 头存在时优先于 X-Forwarded-For。
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies 创建 TrustedProxies, cidrs 可以是 10.0.0.0/8 这样的网段, 也可以是单个 ip
+func NewTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// DefaultTrustedProxies 是 RealIP 和没有设置 Engine.TrustedProxies 时使用的值, 默认
+// 只信任本机 (如同一台机器上的 nginx)
+var DefaultTrustedProxies, _ = NewTrustedProxies("127.0.0.0/8", "::1")
+
+func (p *TrustedProxies) IsTrusted(ip net.IP) bool {
+	return p != nil && containsIP(p.nets, ip)
+}
+
+// ClientIP 返回客户端的 ip
+func (p *TrustedProxies) ClientIP(req *http.Request) string {
+	return p.resolve(req).addr
+}
+
+// Scheme 返回客户端请求的 scheme (http 或 https)
+func (p *TrustedProxies) Scheme(req *http.Request) string {
+	if proto := strings.ToLower(p.resolve(req).proto); proto == "http" || proto == "https" {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Host 返回客户端请求的 host
+func (p *TrustedProxies) Host(req *http.Request) string {
+	if host := p.resolve(req).host; host != "" {
+		return host
+	}
+	return req.Host
+}
+
+// forwardedHop 是转发链中的一个节点
+type forwardedHop struct {
+	addr  string
+	proto string
+	host  string
+}
+
+func (p *TrustedProxies) resolve(req *http.Request) forwardedHop {
+	hop := forwardedHop{addr: stripPort(req.RemoteAddr)}
+	if ip := net.ParseIP(hop.addr); ip == nil || !p.IsTrusted(ip) {
+		return hop
+	}
+
+	hops := parseForwarded(req.Header.Values(HeaderForwarded))
+	isForwarded := len(hops) > 0
+	if !isForwarded {
+		hops = parseXForwardedFor(req.Header.Values(HeaderXForwardedFor))
+	}
+	if len(hops) == 0 {
+		if ip := strings.TrimSpace(req.Header.Get(HeaderXRealIP)); net.ParseIP(ip) != nil {
+			hop.addr = ip
+		}
+	}
+
+	// 从右向左遍历, 遇到不可信的地址时它就是客户端, 遇到无效的地址 (如 Forwarded
+	// 中的 unknown 或者混淆的名称) 时停止, 使用最后一个已知的地址
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i].addr)
+		if ip == nil {
+			break
+		}
+		hop = hops[i]
+		if !p.IsTrusted(ip) {
+			break
+		}
+	}
+
+	if !isForwarded {
+		hop.proto = firstValue(req.Header.Get(HeaderXForwardedProto))
+		hop.host = firstValue(req.Header.Get(HeaderXForwardedHost))
+	}
+	return hop
+}
+
+func firstValue(s string) string {
+	if idx := strings.IndexByte(s, ','); idx >= 0 {
+		s = s[:idx]
+	}
+	return strings.TrimSpace(s)
+}
+
+// stripPort 去掉地址中的端口, 如 1.2.3.4:80 或 [::1]:80, 没有端口时原样返回
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+func parseXForwardedFor(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				hops = append(hops, forwardedHop{addr: stripPort(s)})
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwarded 解析 RFC 7239 的 Forwarded 头, 如
+//
+//	Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var hop forwardedHop
+			for _, pair := range splitQuoted(element, ';') {
+				idx := strings.IndexByte(pair, '=')
+				if idx < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:idx]))
+				val := unquote(strings.TrimSpace(pair[idx+1:]))
+				switch key {
+				case "for":
+					hop.addr = stripPort(val)
+				case "proto":
+					hop.proto = val
+				case "host":
+					hop.host = val
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted 按 sep 分隔 s, 但忽略引号中的 sep
+func splitQuoted(s string, sep byte) []string {
+	var results []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuote {
+				i++
+			}
+		case '"':
+			inQuote = !inQuote
+		case sep:
+			if !inQuote {
+				results = append(results, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(results, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,102 @@
+package loong
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := NewTrustedProxies("10.0.0.0/8", "192.168.1.1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for idx, test := range []struct {
+		remoteAddr string
+		headers    map[string]string
+		clientIP   string
+		scheme     string
+		host       string
+	}{
+		// 对端不可信时忽略所有的头
+		{remoteAddr: "1.2.3.4:1234", headers: map[string]string{HeaderXForwardedFor: "5.6.7.8", HeaderXForwardedProto: "https"},
+			clientIP: "1.2.3.4", scheme: "http", host: "example.com"},
+		{remoteAddr: "10.0.0.1:1234", headers: map[string]string{HeaderXForwardedFor: "5.6.7.8", HeaderXForwardedProto: "https", HeaderXForwardedHost: "www.example.com"},
+			clientIP: "5.6.7.8", scheme: "https", host: "www.example.com"},
+		// 客户端伪造的地址在最左边, 不会被使用
+		{remoteAddr: "10.0.0.1:1234", headers: map[string]string{HeaderXForwardedFor: "6.6.6.6, 5.6.7.8, 10.0.0.2"},
+			clientIP: "5.6.7.8", scheme: "http", host: "example.com"},
+		{remoteAddr: "192.168.1.1:1234", headers: map[string]string{HeaderXForwardedFor: "10.0.0.3, 10.0.0.2"},
+			clientIP: "10.0.0.3", scheme: "http", host: "example.com"},
+		{remoteAddr: "192.168.1.2:1234", headers: map[string]string{HeaderXForwardedFor: "5.6.7.8"},
+			clientIP: "192.168.1.2", scheme: "http", host: "example.com"},
+		{remoteAddr: "10.0.0.1:1234", headers: map[string]string{HeaderXRealIP: "5.6.7.8"},
+			clientIP: "5.6.7.8", scheme: "http", host: "example.com"},
+		{remoteAddr: "10.0.0.1:1234", headers: map[string]string{HeaderXForwardedFor: "not-an-ip, 10.0.0.2"},
+			clientIP: "10.0.0.2", scheme: "http", host: "example.com"},
+
+		// Forwarded 优先于 X-Forwarded-For
+		{remoteAddr: "10.0.0.1:1234", headers: map[string]string{
+			HeaderForwarded:     `for=6.6.6.6;proto=http, for="[2001:db8:cafe::17]:4711";proto=https;host=api.example.com, for=10.0.0.2`,
+			HeaderXForwardedFor: "7.7.7.7"},
+			clientIP: "2001:db8:cafe::17", scheme: "https", host: "api.example.com"},
+		{remoteAddr: "10.0.0.1:1234", headers: map[string]string{HeaderForwarded: `for=unknown, for=10.0.0.2;proto=https`},
+			clientIP: "10.0.0.2", scheme: "https", host: "example.com"},
+		{remoteAddr: "10.0.0.1:1234", headers: map[string]string{HeaderForwarded: `for="_hidden;x", for=5.6.7.8;host="a.example.com"`},
+			clientIP: "5.6.7.8", scheme: "http", host: "a.example.com"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+
+		if ip := proxies.ClientIP(req); ip != test.clientIP {
+			t.Error(idx, "want", test.clientIP, "got", ip)
+		}
+		if scheme := proxies.Scheme(req); scheme != test.scheme {
+			t.Error(idx, "want", test.scheme, "got", scheme)
+		}
+		if host := proxies.Host(req); host != test.host {
+			t.Error(idx, "want", test.host, "got", host)
+		}
+	}
+
+	if _, err := NewTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestContextClientIP(t *testing.T) {
+	e := New()
+	e.GET("/ip", func(c *Context) error {
+		return c.String(http.StatusOK, c.ClientIP()+","+c.RealIP()+","+c.BaseURL())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/ip", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(HeaderXForwardedFor, "5.6.7.8")
+	req.Header.Set(HeaderXForwardedProto, "https")
+
+	// 默认只信任本机
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if body := rec.Body.String(); body != "10.0.0.1,10.0.0.1,http://example.com" {
+		t.Error("got", body)
+	}
+	if ip := RealIP(req); ip != "10.0.0.1" {
+		t.Error("got", ip)
+	}
+
+	e.TrustedProxies, _ = NewTrustedProxies("10.0.0.0/8")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if body := rec.Body.String(); body != "5.6.7.8,5.6.7.8,https://example.com" {
+		t.Error("got", body)
+	}
+	if ip := e.Echo.IPExtractor(req); ip != "5.6.7.8" {
+		t.Error("got", ip)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package loong
+
+import (
+	"sync"
+	"syscall"
+)
+
+// umask 是整个进程的, 同时监听多个 socket 时不能互相覆盖
+var umaskLock sync.Mutex
+
+// setPrivateUmask 将 umask 设为 0177, 返回恢复原来的 umask 的函数。监听期间其它
+// goroutine 创建的文件的权限也会变严格, 但不会变宽松
+func setPrivateUmask() func() {
+	umaskLock.Lock()
+	old := syscall.Umask(0177)
+	return func() {
+		syscall.Umask(old)
+		umaskLock.Unlock()
+	}
+}
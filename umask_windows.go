@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package loong
+
+// windows 中没有 umask
+func setPrivateUmask() func() {
+	return func() {}
+}
@@ -0,0 +1,127 @@
+package loong
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/runner-mei/errors"
+)
+
+// IsAbstractUnixAddress 判断是否为 Linux 的抽象 socket 地址, 如 "@name"
+func IsAbstractUnixAddress(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// NewUnixSocketTransport 返回一个所有连接都发往 unix socket address 的 http.Transport,
+// 请求的 URL 中的 host 会被忽略, 如 http://unix/path
+func NewUnixSocketTransport(address string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", address)
+		},
+	}
+}
+
+// listenUnixPrivate 在监听时将 umask 设为 0177, socket 文件创建时的权限为 0600,
+// 这样在 chmodUnixSocket 修改所有者和权限之前其它用户不能连接
+func listenUnixPrivate(listen func() (string, net.Listener, error)) (string, net.Listener, error) {
+	restore := setPrivateUmask()
+	defer restore()
+	return listen()
+}
+
+func listenUnix(address string) (net.Listener, error) {
+	if address == "" {
+		return nil, errors.New("listen: unix socket path is missing")
+	}
+
+	if !IsAbstractUnixAddress(address) {
+		if err := removeStaleUnixSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", address)
+}
+
+// removeStaleUnixSocket 删除上次进程异常退出时遗留的 socket 文件,
+// 如果还有进程在监听它就返回错误
+func removeStaleUnixSocket(address string) error {
+	fi, err := os.Lstat(address)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New("listen: '" + address + "' already exists and isnot a socket")
+	}
+
+	conn, err := net.DialTimeout("unix", address, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.New("listen: unix socket '" + address + "' is in use")
+	}
+
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale unix socket '"+address+"' fail")
+	}
+	return nil
+}
+
+// chmodUnixSocket 设置 socket 文件的所有者和权限, mode 为 0 或 owner 为空时不修改。
+// 先修改所有者再修改权限, 这样不会有一段时间原来的组可以连接
+func chmodUnixSocket(address string, mode os.FileMode, username, groupname string) error {
+	if IsAbstractUnixAddress(address) {
+		return nil
+	}
+
+	if err := chownUnixSocket(address, username, groupname); err != nil {
+		return err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(address, mode); err != nil {
+			return errors.Wrap(err, "chmod unix socket '"+address+"' fail")
+		}
+	}
+	return nil
+}
+
+func chownUnixSocket(address, username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return errors.Wrap(err, "lookup user '"+username+"' fail")
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return errors.Wrap(err, "user '"+username+"' has invalid uid")
+		}
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return errors.Wrap(err, "lookup group '"+groupname+"' fail")
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return errors.Wrap(err, "group '"+groupname+"' has invalid gid")
+		}
+	}
+	if err := os.Chown(address, uid, gid); err != nil {
+		return errors.Wrap(err, "chown unix socket '"+address+"' fail")
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package loong
 
 import (
 	"context"
-	"net"
 	"net/http"
 	"strings"
 )
@@ -87,16 +86,10 @@ func RequestFromContext(ctx context.Context) *http.Request {
 	return req
 }
 
+// RealIP 返回客户端的 ip, 它只信任 DefaultTrustedProxies 中的代理, 在 Engine 的
+// handler 中应该使用 Context.ClientIP
 func RealIP(req *http.Request) string {
-	ra := req.RemoteAddr
-	if ip := req.Header.Get(HeaderXForwardedFor); ip != "" {
-		ra = ip
-	} else if ip := req.Header.Get(HeaderXRealIP); ip != "" {
-		ra = ip
-	} else {
-		ra, _, _ = net.SplitHostPort(ra)
-	}
-	return ra
+	return DefaultTrustedProxies.ClientIP(req)
 }
 
 func IsConsumeJSON(r *http.Request) bool {